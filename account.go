@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrAccountNotFound = errors.New("account not found")
+	ErrAccountExists   = errors.New("account already exists")
+)
+
+/* Passwords shorter than this are refused. bcrypt ignores
+   anything past 72 bytes, so longer ones are refused too. */
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+/* bcrypt work factor for new passwords. */
+var passwordCost = bcrypt.DefaultCost
+
+/* A registered user. The name is reserved for whoever knows the
+   password; guests may use any other name. */
+type Account struct {
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"passwordHash"`
+	Created      time.Time `json:"created"`
+}
+
+/* Registered accounts. Implementations must be safe for concurrent
+   use. The game stores keep accounts alongside the games. */
+type AccountStore interface {
+	/* Fails with ErrAccountExists if the name is taken. */
+	CreateAccount(account *Account) error
+	GetAccount(username string) (*Account, error)
+}
+
+func NewAccount(username string, password string) (*Account, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return nil, fmt.Errorf("password must be %v to %v characters long", minPasswordLength, maxPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash password: %v", err)
+	}
+	return &Account{
+		Username:     username,
+		PasswordHash: hash,
+		Created:      time.Now(),
+	}, nil
+}
+
+func (a *Account) checkPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(a.PasswordHash, []byte(password)) == nil
+}
+
+func (s *MemoryStore) CreateAccount(account *Account) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.accounts[account.Username]; exists {
+		return ErrAccountExists
+	}
+	s.accounts[account.Username] = account
+	return nil
+}
+
+func (s *MemoryStore) GetAccount(username string) (*Account, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	account, exists := s.accounts[username]
+	if !exists {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+var accountsBucket = []byte("accounts")
+
+func (s *BoltStore) CreateAccount(account *Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("could not marshal account %v: %v", account.Username, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		accounts := tx.Bucket(accountsBucket)
+		if accounts.Get([]byte(account.Username)) != nil {
+			return ErrAccountExists
+		}
+		return accounts.Put([]byte(account.Username), data)
+	})
+}
+
+func (s *BoltStore) GetAccount(username string) (*Account, error) {
+	var account Account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(accountsBucket).Get([]byte(username))
+		if data == nil {
+			return ErrAccountNotFound
+		}
+		return json.Unmarshal(data, &account)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	/* Empty for guests. */
+	Password string `json:"password"`
+}
+
+/* Create an account: POST /register {"username": ..., "password": ...} */
+func (m *Manager) registerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST to register", http.StatusMethodNotAllowed)
+		return
+	}
+	/* Hashing is slow on purpose; count it as a login. */
+	if ok, wait := m.loginLimiter.allow(clientAddr(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many attempts. Try again in a few seconds.", http.StatusTooManyRequests)
+		return
+	}
+
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validUsername(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	used, err := m.usedByGuest(req.Username)
+	if err != nil {
+		log.Error().Err(err).Str("user", req.Username).Msg("could not look up guest")
+		http.Error(w, "Could not register. Try again shortly.", http.StatusServiceUnavailable)
+		return
+	}
+	if used {
+		http.Error(w,
+			"User name \"" + req.Username + "\" has been used by a guest. Choose a different username.",
+			http.StatusConflict)
+		return
+	}
+	account, err := NewAccount(req.Username, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = m.accounts.CreateAccount(account)
+	if errors.Is(err, ErrAccountExists) {
+		http.Error(w,
+			"User name \"" + req.Username + "\" is already registered. Choose a different username.",
+			http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, accountSummary{Username: account.Username, Created: account.Created})
+}
+
+/* Whether a guest is connected with the name, on any instance, or has
+   played under it. An account would take over the guest's session, or
+   their games and stats. */
+func (m *Manager) usedByGuest(username string) (bool, error) {
+	m.RLock()
+	_, connected := m.clients[username]
+	m.RUnlock()
+	if connected {
+		return true, nil
+	}
+	owner, err := m.broker.Claim(userClaim(username), m.id, ownershipTTL)
+	if err != nil {
+		return false, err
+	}
+	if owner != m.id {
+		return true, nil
+	}
+	/* Nobody had the name. A login here since claims it again when
+	   it connects. */
+	m.broker.Release(userClaim(username), m.id)
+
+	records, err := m.store.ByUser(username)
+	if err != nil {
+		return false, err
+	}
+	return len(records) > 0, nil
+}
+
+type accountSummary struct {
+	Username string        `json:"username"`
+	Created  time.Time     `json:"created"`
+	Stats    *PlayerStats  `json:"stats,omitempty"`
+	Games    []GameSummary `json:"games,omitempty"`
+}
+
+/* A registered user's stats and games: /account?user=<name> */
+func (m *Manager) accountHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("user")
+	account, err := m.accounts.GetAccount(name)
+	if errors.Is(err, ErrAccountNotFound) {
+		http.Error(w, "no account named "+name, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	records, err := m.store.ByUser(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	summary := accountSummary{
+		Username: account.Username,
+		Created:  account.Created,
+		Games:    summarizeGames(records),
+	}
+	if ps, exists := computeStats(records)[name]; exists {
+		ps.summarize()
+		summary.Stats = ps
+	}
+	writeJSON(w, summary)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func checkAccountStore(t *testing.T, store AccountStore) {
+	t.Helper()
+	passwordCost = bcrypt.MinCost
+
+	if _, err := NewAccount("alice", "short"); err == nil {
+		t.Error("short password accepted")
+	}
+	account, err := NewAccount("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	again, _ := NewAccount("alice", "battery staple")
+	if err := store.CreateAccount(again); err != ErrAccountExists {
+		t.Errorf("expected ErrAccountExists, got %v", err)
+	}
+
+	got, err := store.GetAccount("alice")
+	if err != nil {
+		t.Fatalf("GetAccount: %v", err)
+	}
+	if !got.checkPassword("correct horse") || got.checkPassword("battery staple") {
+		t.Error("the first password should be the account's, and only it")
+	}
+	if _, err := store.GetAccount("bob"); err != ErrAccountNotFound {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+}
+
+func TestAccountStores(t *testing.T) {
+	checkAccountStore(t, NewMemoryStore(memoryStoreGames))
+
+	path := filepath.Join(t.TempDir(), "games.db")
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccountStore(t, store)
+	store.Close()
+
+	/* Accounts survive a restart. */
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if account, err := store.GetAccount("alice"); err != nil || !account.checkPassword("correct horse") {
+		t.Errorf("account not kept: %v", err)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	passwordCost = bcrypt.MinCost
+	manager := NewManager(context.Background())
+	unlimitedLogins(manager)
+	post := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+	}{
+		{"register", manager.registerHandler, `{"username": "alice", "password": "correct horse"}`, http.StatusOK},
+		{"register again", manager.registerHandler, `{"username": "alice", "password": "battery staple"}`, http.StatusConflict},
+		{"register bad name", manager.registerHandler, `{"username": "a b", "password": "correct horse"}`, http.StatusBadRequest},
+		{"register short password", manager.registerHandler, `{"username": "bob", "password": "pw"}`, http.StatusBadRequest},
+		{"guest with a registered name", manager.loginHandler, `{"username": "alice"}`, http.StatusUnauthorized},
+		{"wrong password", manager.loginHandler, `{"username": "alice", "password": "battery staple"}`, http.StatusUnauthorized},
+		{"password without account", manager.loginHandler, `{"username": "bob", "password": "correct horse"}`, http.StatusUnauthorized},
+		{"guest", manager.loginHandler, `{"username": "bob"}`, http.StatusOK},
+		{"account", manager.loginHandler, `{"username": "alice", "password": "correct horse"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		if w := post(test.handler, test.body); w.Code != test.status {
+			t.Errorf("%v: expected status %v, got %v: %v", test.name, test.status, w.Code, w.Body)
+		}
+	}
+
+	var login struct {
+		OTP        string `json:"otp"`
+		Registered bool   `json:"registered"`
+	}
+	json.NewDecoder(post(manager.loginHandler, `{"username": "carol"}`).Body).Decode(&login)
+	if login.OTP == "" || login.Registered {
+		t.Errorf("guest login: %+v", login)
+	}
+
+	/* The account's games and stats. */
+	manager.store.Save(&GameRecord{
+		ID: "game1", Room: "den",
+		Players: []Participant{{Name: "alice", Team: red, Role: guesser, Registered: true}},
+		Winner: red, Cause: OutcomeAllCards,
+	})
+	w := httptest.NewRecorder()
+	manager.accountHandler(w, httptest.NewRequest(http.MethodGet, "/account?user=alice", nil))
+	var summary accountSummary
+	json.NewDecoder(w.Body).Decode(&summary)
+	if len(summary.Games) != 1 || summary.Stats == nil || summary.Stats.Wins[guesser] != 1 {
+		t.Errorf("account summary: %+v", summary)
+	}
+
+	w = httptest.NewRecorder()
+	manager.accountHandler(w, httptest.NewRequest(http.MethodGet, "/account?user=bob", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("guests have no account: got status %v", w.Code)
+	}
+
+	/* Names guests have played under, or are connected with, are
+	   theirs. */
+	manager.store.Save(&GameRecord{
+		ID: "game2", Room: "den",
+		Players: []Participant{{Name: "dave", Team: red, Role: guesser}},
+		Winner: red, Cause: OutcomeAllCards,
+	})
+	manager.addClient(NewClient("erin", nil, manager))
+	for _, name := range []string{"dave", "erin"} {
+		if w := post(manager.registerHandler, `{"username": "`+name+`", "password": "correct horse"}`); w.Code != http.StatusConflict {
+			t.Errorf("register guest %v: got status %v", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+/* Shortest admin token accepted, in bytes. */
+const minAdminTokenLength = 16
+
+const (
+	kickMessage    = "You have been disconnected by an admin."
+	endGameMessage = "This game was ended by an admin."
+)
+
+/* The admin token: the token itself if given, else the contents of
+   the file. No token, and no file, disables the admin API. */
+func readAdminToken(token string, path string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+/* Let the request through to the handler only if it carries the
+   admin token: "Authorization: Bearer <token>". */
+func (m *Manager) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.adminToken == "" {
+			http.Error(w, "The admin API is disabled", http.StatusNotFound)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(m.adminToken)) != 1 {
+			/* Guessing tokens costs as much as guessing passwords. */
+			if ok, wait := m.loginLimiter.allow(clientAddr(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "Too many attempts. Try again in a few seconds.", http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing or wrong admin token", http.StatusUnauthorized)
+			return
+		}
+		log.Info().Str("method", r.Method).Str("path", r.URL.Path).Str("addr", clientAddr(r)).
+			Msg("admin request")
+		handler(w, r)
+	}
+}
+
+/* Decode the JSON body of an admin POST request. Returns false, having
+   replied, if the request is not one. */
+func adminRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	/* An empty body leaves the defaults. */
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+/* The manager's rooms, by name. */
+func (m *Manager) rooms() []*Room {
+	m.RLock()
+	rooms := make([]*Room, 0, len(m.chats))
+	for _, room := range m.chats {
+		rooms = append(rooms, room)
+	}
+	m.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].name < rooms[j].name
+	})
+	return rooms
+}
+
+/* How long admin requests wait for rooms, which may be busy with
+   e.g. a bot's turn. */
+var adminRoomTimeout = 2 * time.Second
+
+/* Ask each room a question on its goroutine, all at once, waiting at
+   most timeout for the answers. Answers are in room order; a query
+   that returns false has no answer. Rooms that did not answer in time
+   are named in busy. */
+func queryRooms[T any](rooms []*Room, timeout time.Duration, query func(room *Room) (T, bool)) (answers []T, busy []string) {
+	type answer struct {
+		i     int
+		value T
+		ok    bool
+	}
+	answered := make(chan answer, len(rooms))
+	for i, room := range rooms {
+		i, room := i, room
+		queued := room.post(func() {
+			value, ok := query(room)
+			answered <- answer{i, value, ok}
+		})
+		/* The room has closed, so there is nothing to ask it. */
+		if !queued {
+			answered <- answer{i: i}
+		}
+	}
+
+	got := make([]*answer, len(rooms))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for n := 0; n < len(rooms); n++ {
+		select {
+		case a := <-answered:
+			got[a.i] = &a
+		case <-timer.C:
+			n = len(rooms)
+		}
+	}
+	for i, a := range got {
+		switch {
+		case a == nil:
+			busy = append(busy, rooms[i].name)
+		case a.ok:
+			answers = append(answers, a.value)
+		}
+	}
+	return answers, busy
+}
+
+type adminRoom struct {
+	Name         string        `json:"name"`
+	Participants []Participant `json:"participants"`
+	/* The ID of the room's game, if there is one. */
+	Game         string        `json:"game,omitempty"`
+	/* The room did not answer in time, so the rest is unknown. */
+	Busy         bool          `json:"busy,omitempty"`
+}
+
+/* Rooms on this instance and who is in them: GET /admin/rooms */
+func (m *Manager) adminRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	rooms := m.rooms()
+	answers, busy := queryRooms(rooms, adminRoomTimeout, func(room *Room) (adminRoom, bool) {
+		ar := adminRoom{
+			Name:         room.name,
+			Participants: room.clients.listClients(),
+		}
+		if game := m.game(room.name); game != nil {
+			ar.Game = game.id
+		}
+		return ar, true
+	})
+	list := make([]adminRoom, 0, len(rooms))
+	list = append(list, answers...)
+	for _, name := range busy {
+		list = append(list, adminRoom{Name: name, Participants: []Participant{}, Busy: true})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	writeJSON(w, list)
+}
+
+type adminGame struct {
+	ID             string        `json:"id"`
+	Room           string        `json:"room"`
+	Active         bool          `json:"active"`
+	Started        time.Time     `json:"started"`
+	Players        []Participant `json:"players"`
+	Bots           BotActions    `json:"bots"`
+	TeamTurn       Team          `json:"teamTurn"`
+	RoleTurn       Role          `json:"roleTurn"`
+	GuessRemaining int           `json:"guessRemaining"`
+	Score          Score         `json:"score"`
+	Winner         Team          `json:"winner,omitempty"`
+	Cause          string        `json:"cause,omitempty"`
+	Usage          Usage         `json:"usage"`
+}
+
+/* Games on this instance and their state: GET /admin/games
+   Games in rooms too busy to answer are left out. */
+func (m *Manager) adminGamesHandler(w http.ResponseWriter, r *http.Request) {
+	answers, busy := queryRooms(m.rooms(), adminRoomTimeout, func(room *Room) (adminGame, bool) {
+		game := m.game(room.name)
+		if game == nil {
+			return adminGame{}, false
+		}
+		ag := adminGame{
+			ID:             game.id,
+			Room:           game.name,
+			Active:         game.active,
+			Players:        game.players.listClients(),
+			Bots:           game.bots,
+			TeamTurn:       game.teamTurn,
+			RoleTurn:       game.roleTurn,
+			GuessRemaining: game.guessRemaining,
+			Score:          maps.Clone(game.score),
+			Winner:         game.winner,
+			Cause:          game.cause,
+			Usage:          game.usage,
+		}
+		if len(game.history) > 0 {
+			ag.Started = game.history[0].Time
+		}
+		return ag, true
+	})
+	if len(busy) > 0 {
+		log.Warn().Strs("rooms", busy).Msg("admin: rooms too busy to list their games")
+	}
+	list := []adminGame{}
+	list = append(list, answers...)
+	writeJSON(w, list)
+}
+
+type adminKickRequest struct {
+	Username string   `json:"username"`
+	/* Shown to the user; a default if empty. */
+	Message  string   `json:"message"`
+	/* Refuse the user's address for this long, e.g. "1h". Without
+	   it, the user is only disconnected and may log in again. */
+	Ban      Duration `json:"ban"`
+}
+
+/* Disconnect a user: POST /admin/kick {"username": ..., "message": ..., "ban": ...}
+   Only users connected to this instance can be kicked from it. */
+func (m *Manager) adminKickHandler(w http.ResponseWriter, r *http.Request) {
+	var req adminKickRequest
+	if !adminRequest(w, r, &req) {
+		return
+	}
+	m.RLock()
+	client, exists := m.clients[req.Username]
+	m.RUnlock()
+	if !exists {
+		http.Error(w, req.Username+" is not connected to this instance", http.StatusNotFound)
+		return
+	}
+	if req.Message == "" {
+		req.Message = kickMessage
+	}
+
+	client.logger().Warn().Str("message", req.Message).Dur("ban", time.Duration(req.Ban)).
+		Msg("kicked by admin")
+	if req.Ban > 0 && client.addr != "" {
+		m.bans.ban(client.addr, time.Duration(req.Ban))
+	}
+	client.sendResponse(EventServerNotice, "", ServerNoticeEvent{Message: req.Message})
+	client.close(websocket.ClosePolicyViolation, "kicked", time.Now().Add(time.Second))
+	/* A client without a connection has no readMessages to remove it. */
+	if client.connection == nil {
+		m.removeClient(client)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminEndGameRequest struct {
+	Room    string `json:"room"`
+	/* Shown to the players; a default if empty. */
+	Message string `json:"message"`
+}
+
+/* End a room's game: POST /admin/end-game {"room": ..., "message": ...} */
+func (m *Manager) adminEndGameHandler(w http.ResponseWriter, r *http.Request) {
+	var req adminEndGameRequest
+	if !adminRequest(w, r, &req) {
+		return
+	}
+	room := m.room(req.Room)
+	if room == nil {
+		http.Error(w, "chat room "+req.Room+" is not on this instance", http.StatusNotFound)
+		return
+	}
+	if req.Message == "" {
+		req.Message = endGameMessage
+	}
+
+	answers, busy := queryRooms([]*Room{room}, adminRoomTimeout, func(room *Room) (bool, bool) {
+		game := m.game(room.name)
+		if game == nil || !game.active {
+			return false, true
+		}
+		game.log.Warn().Str("message", req.Message).Msg("game ended by admin")
+		game.cause = OutcomeStopped
+		m.removeGame(room.name, req.Message)
+		return true, true
+	})
+	if len(busy) > 0 {
+		/* The room will get to it. */
+		http.Error(w, "chat room "+req.Room+" is busy; the game will end when it is free", http.StatusAccepted)
+		return
+	}
+	if !answers[0] {
+		http.Error(w, "no game in progress in "+req.Room, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminNoticeRequest struct {
+	Message string `json:"message"`
+}
+
+/* Tell everyone connected to this instance something, in whichever
+   room they are: POST /admin/notice {"message": ...} */
+func (m *Manager) adminNoticeHandler(w http.ResponseWriter, r *http.Request) {
+	var req adminNoticeRequest
+	if !adminRequest(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		http.Error(w, "message must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	notice, err := packageMessage(EventServerNotice, ServerNoticeEvent{Message: req.Message})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.RLock()
+	for _, client := range m.clients {
+		client.send(notice)
+	}
+	m.RUnlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminWordListRequest struct {
+	/* Empty reloads the file the word list was read from. */
+	Path string `json:"path"`
+}
+
+type adminWordListResponse struct {
+	Path  string `json:"path"`
+	Words int    `json:"words"`
+}
+
+/* Read the word list again, for the games started from now on:
+   POST /admin/reload-words {"path": ...} */
+func (m *Manager) adminReloadWordsHandler(w http.ResponseWriter, r *http.Request) {
+	var req adminWordListRequest
+	if !adminRequest(w, r, &req) {
+		return
+	}
+	if req.Path == "" {
+		wordsMu.RLock()
+		req.Path = wordListPath
+		wordsMu.RUnlock()
+	}
+
+	words, err := reloadWordList(req.Path)
+	if err != nil {
+		/* The old list stays in use. */
+		http.Error(w, "could not reload word list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info().Str("path", req.Path).Int("words", words).Msg("word list reloaded")
+	writeJSON(w, adminWordListResponse{Path: req.Path, Words: words})
+}
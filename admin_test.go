@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+func adminCall(manager *Manager, handler http.HandlerFunc, method string, body string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/admin", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	manager.admin(handler)(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	manager := NewManager(context.Background())
+	if w := adminCall(manager, manager.adminRoomsHandler, http.MethodGet, "", testAdminToken); w.Code != http.StatusNotFound {
+		t.Errorf("admin API without a token: got %v", w.Code)
+	}
+
+	manager.adminToken = testAdminToken
+	if w := adminCall(manager, manager.adminRoomsHandler, http.MethodGet, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got %v", w.Code)
+	}
+	if w := adminCall(manager, manager.adminRoomsHandler, http.MethodGet, "", "fedcba9876543210"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %v", w.Code)
+	}
+	if w := adminCall(manager, manager.adminRoomsHandler, http.MethodGet, "", testAdminToken); w.Code != http.StatusOK {
+		t.Errorf("right token: got %v", w.Code)
+	}
+	if w := adminCall(manager, manager.adminKickHandler, http.MethodGet, "", testAdminToken); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("kick with GET: got %v", w.Code)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	manager.adminToken = testAdminToken
+	alice := NewClient("alice", nil, manager)
+	bob := NewClient("bob", nil, manager)
+	bob.role = cluegiver
+	manager.addClient(alice)
+	manager.addClient(bob)
+	room, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, alice)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, bob)
+	manager.routeEvent(Event{Type: EventNewGame, Payload: json.RawMessage(`{}`)}, alice)
+	waitForEvent(t, alice, EventNewGame)
+	waitForEvent(t, bob, EventNewGame)
+
+	w := adminCall(manager, manager.adminRoomsHandler, http.MethodGet, "", testAdminToken)
+	var rooms []adminRoom
+	json.Unmarshal(w.Body.Bytes(), &rooms)
+	if len(rooms) != 2 || rooms[0].Name != "den" || len(rooms[0].Participants) != 2 || rooms[0].Game == "" ||
+		rooms[1].Name != defaultChatRoom || len(rooms[1].Participants) != 0 {
+		t.Errorf("rooms: %+v", rooms)
+	}
+
+	w = adminCall(manager, manager.adminGamesHandler, http.MethodGet, "", testAdminToken)
+	var games []adminGame
+	json.Unmarshal(w.Body.Bytes(), &games)
+	if len(games) != 1 || games[0].ID != rooms[0].Game || !games[0].Active || len(games[0].Players) != 2 {
+		t.Errorf("games: %+v", games)
+	}
+
+	/* Everyone hears a notice. */
+	w = adminCall(manager, manager.adminNoticeHandler, http.MethodPost, `{"message": "Restart at noon"}`, testAdminToken)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("notice: got %v", w.Code)
+	}
+	for _, c := range []*Client{alice, bob} {
+		var notice ServerNoticeEvent
+		json.Unmarshal(waitForEvent(t, c, EventServerNotice).Payload, &notice)
+		if notice.Message != "Restart at noon" {
+			t.Errorf("%v got notice %q", c.username, notice.Message)
+		}
+	}
+
+	/* Ending the game tells the players why, and saves it. */
+	w = adminCall(manager, manager.adminEndGameHandler, http.MethodPost, `{"room": "den", "message": "Closing time"}`, testAdminToken)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("end game: got %v", w.Code)
+	}
+	var over GameOverEvent
+	json.Unmarshal(waitForEvent(t, alice, EventGameOver).Payload, &over)
+	if over.Message != "Closing time" {
+		t.Errorf("game over message %q", over.Message)
+	}
+	if record, err := manager.store.Get(games[0].ID); err != nil || record.Cause != OutcomeStopped {
+		t.Errorf("saved game: %+v, %v", record, err)
+	}
+	if w := adminCall(manager, manager.adminEndGameHandler, http.MethodPost, `{"room": "den"}`, testAdminToken); w.Code != http.StatusNotFound {
+		t.Errorf("ending a finished game: got %v", w.Code)
+	}
+
+	/* Kicked users are told, and leave. */
+	w = adminCall(manager, manager.adminKickHandler, http.MethodPost, `{"username": "bob"}`, testAdminToken)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("kick: got %v", w.Code)
+	}
+	var notice ServerNoticeEvent
+	json.Unmarshal(waitForEvent(t, bob, EventServerNotice).Payload, &notice)
+	if notice.Message != kickMessage {
+		t.Errorf("kick notice %q", notice.Message)
+	}
+	manager.RLock()
+	_, exists := manager.clients["bob"]
+	manager.RUnlock()
+	if exists {
+		t.Error("bob still connected")
+	}
+	if w := adminCall(manager, manager.adminKickHandler, http.MethodPost, `{"username": "bob"}`, testAdminToken); w.Code != http.StatusNotFound {
+		t.Errorf("kicking a user who is not here: got %v", w.Code)
+	}
+	if manager.bans.banned(bob.addr) {
+		t.Error("kick without a ban banned bob")
+	}
+
+	/* A kick may also keep the user out for a while. */
+	alice.addr = "192.0.2.1"
+	w = adminCall(manager, manager.adminKickHandler, http.MethodPost, `{"username": "alice", "ban": "1h"}`, testAdminToken)
+	if w.Code != http.StatusNoContent || !manager.bans.banned(alice.addr) {
+		t.Errorf("kick with a ban: got %v, banned %v", w.Code, manager.bans.banned(alice.addr))
+	}
+}
+
+/* A room busy with e.g. a bot's turn doesn't hold up the admin API. */
+func TestAdminBusyRoom(t *testing.T) {
+	defer func(timeout time.Duration) {
+		adminRoomTimeout = timeout
+	}(adminRoomTimeout)
+	adminRoomTimeout = 50 * time.Millisecond
+	manager := setupGame(t, nil, nil)
+	manager.adminToken = testAdminToken
+	room := manager.makeChatRoom("test")
+	release := make(chan struct{})
+	defer close(release)
+	room.post(func() {
+		<-release
+	})
+
+	w := adminCall(manager, manager.adminRoomsHandler, http.MethodGet, "", testAdminToken)
+	var rooms []adminRoom
+	json.Unmarshal(w.Body.Bytes(), &rooms)
+	if len(rooms) != 2 || rooms[0].Name != defaultChatRoom || rooms[0].Busy || rooms[1].Name != "test" || !rooms[1].Busy {
+		t.Errorf("rooms: %+v", rooms)
+	}
+	w = adminCall(manager, manager.adminGamesHandler, http.MethodGet, "", testAdminToken)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("games: %v %v", w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodGet, "/admin/transcript?id="+manager.games["test"].id, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w = httptest.NewRecorder()
+	manager.admin(manager.adminTranscriptHandler)(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("transcript of a game in a busy room: got %v", w.Code)
+	}
+}
+
+func TestAdminReloadWords(t *testing.T) {
+	readWordList("./wordlist.txt")
+	defer reloadWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	manager.adminToken = testAdminToken
+
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short.txt")
+	os.WriteFile(short, []byte("one\ntwo\nthree\n"), 0600)
+	w := adminCall(manager, manager.adminReloadWordsHandler, http.MethodPost, `{"path": "`+short+`"}`, testAdminToken)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("short word list: got %v", w.Code)
+	}
+	if wordListPath != "./wordlist.txt" {
+		t.Errorf("bad word list replaced the old one: %v", wordListPath)
+	}
+
+	words := make([]string, totalNumCards)
+	for i := range words {
+		words[i] = "word" + string(rune('a'+i))
+	}
+	path := filepath.Join(dir, "words.txt")
+	os.WriteFile(path, []byte(strings.Join(words, "\n")), 0600)
+	w = adminCall(manager, manager.adminReloadWordsHandler, http.MethodPost, `{"path": "`+path+`"}`, testAdminToken)
+	var resp adminWordListResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Words != totalNumCards {
+		t.Errorf("reload: got %v, %+v", w.Code, resp)
+	}
+	for card := range getCards() {
+		if !strings.HasPrefix(card, "WORD") {
+			t.Errorf("card %v not from the new list", card)
+		}
+	}
+
+	/* No path reloads the same file. */
+	w = adminCall(manager, manager.adminReloadWordsHandler, http.MethodPost, "", testAdminToken)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Path != path {
+		t.Errorf("reload again: got %v, %+v", w.Code, resp)
+	}
+}
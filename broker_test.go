@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+/* expire lets the broker's clock run past a claim's ttl. */
+func checkBroker(t *testing.T, broker Broker, expire func(time.Duration)) {
+	t.Helper()
+
+	received := make(chan string, 10)
+	unsubscribe, err := broker.Subscribe("topic", func(data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := broker.Publish("topic", []byte(msg)); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	unsubscribe()
+
+	claim := func(key string, owner string, ttl time.Duration, want string) {
+		t.Helper()
+		got, err := broker.Claim(key, owner, ttl)
+		if err != nil || got != want {
+			t.Errorf("Claim(%v, %v): expected %v, got %v, %v", key, owner, want, got, err)
+		}
+	}
+	claim("room.den", "A", time.Minute, "A")
+	claim("room.den", "B", time.Minute, "A")
+	claim("room.den", "A", time.Minute, "A")
+	broker.Release("room.den", "B")
+	claim("room.den", "B", time.Minute, "A")
+	broker.Release("room.den", "A")
+	claim("room.den", "B", time.Minute, "B")
+
+	claim("room.attic", "A", 100*time.Millisecond, "A")
+	expire(200 * time.Millisecond)
+	claim("room.attic", "B", time.Minute, "B")
+
+	take := func(key string, want string) {
+		t.Helper()
+		got, err := broker.Take(key)
+		if err != nil || got != want {
+			t.Errorf("Take(%v): expected %q, got %q, %v", key, want, got, err)
+		}
+	}
+	take("room.attic", "B")
+	take("room.attic", "")
+	claim("room.attic", "A", time.Minute, "A")
+	claim("otp.key", "alice", 100*time.Millisecond, "alice")
+	expire(200 * time.Millisecond)
+	take("otp.key", "")
+}
+
+func TestLocalBroker(t *testing.T) {
+	checkBroker(t, NewLocalBroker(), time.Sleep)
+}
+
+/* Messages still waiting when a subscriber leaves are dropped, and
+   its queue takes no more. */
+func TestLocalUnsubscribe(t *testing.T) {
+	broker := NewLocalBroker()
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	unsubscribe, _ := broker.Subscribe("topic", func(data []byte) {
+		started <- struct{}{}
+		<-release
+		received <- string(data)
+	})
+	broker.Publish("topic", []byte("one"))
+	broker.Publish("topic", []byte("two"))
+	<-started
+	unsubscribe()
+	close(release)
+
+	select {
+	case got := <-received:
+		if got != "one" {
+			t.Errorf("expected the message being handled, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the message being handled")
+	}
+	select {
+	case got := <-received:
+		t.Errorf("received %q after unsubscribing", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if subs := broker.subscriptions["topic"]; len(subs) != 0 {
+		t.Errorf("subscriptions: %v", subs)
+	}
+}
+
+func TestRedisBroker(t *testing.T) {
+	server := miniredis.RunT(t)
+	broker, err := OpenRedisBroker("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("could not open broker: %v", err)
+	}
+	defer broker.Close()
+
+	checkBroker(t, broker, server.FastForward)
+}
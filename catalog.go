@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+/* Highest sampling temperature a seat may ask for. */
+const maxTemperature = 2
+
+/* The persona that adds nothing to the bot's instructions. */
+const standardPersona = "standard"
+
+/* A model bots may play with, by the name players pick it by. */
+type CatalogModel struct {
+	Name        string `json:"name"`
+	/* One of the providers; empty is the bots' default provider. */
+	Provider    string `json:"provider,omitempty"`
+	/* The provider's name for the model; empty is Name. */
+	Model       string `json:"model,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+/* A way of playing, added to the bot's instructions. */
+type Persona struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Prompt      string `json:"prompt,omitempty"`
+}
+
+/* What players may pick for each bot seat. The first model is the
+   default. Without models, the catalog offers -bot-model from
+   -bot-provider; without personas, the built-in ones. */
+type BotCatalog struct {
+	Models   []CatalogModel `json:"models,omitempty"`
+	Personas []Persona      `json:"personas,omitempty"`
+}
+
+var defaultPersonas = []Persona{
+	{
+		Name:        standardPersona,
+		Description: "Plays it straight.",
+	},
+	{
+		Name:        "cautious",
+		Description: "Takes few risks.",
+		Prompt: "Play cautiously. As the spymaster, give clues for fewer words " +
+			"that cannot be confused with the opposing team's words. As a field " +
+			"operative, guess only the words you are sure of.",
+	},
+	{
+		Name:        "bold",
+		Description: "Goes for big clues.",
+		Prompt: "Play boldly. As the spymaster, give clues that link as many of " +
+			"your team's words as you can. As a field operative, guess every word " +
+			"that could fit the clue.",
+	},
+	{
+		Name:        "beginner",
+		Description: "An easy opponent.",
+		Prompt: "Play like someone new to the game. As the spymaster, give simple, " +
+			"literal clues for one or two words. As a field operative, guess the " +
+			"most obvious words.",
+	},
+}
+
+/* Set from the config at startup. */
+var botCatalog BotCatalog
+
+func (c BotCatalog) models() []CatalogModel {
+	if len(c.Models) == 0 {
+		return []CatalogModel{{Name: botModel}}
+	}
+	return c.Models
+}
+
+func (c BotCatalog) personas() []Persona {
+	if len(c.Personas) == 0 {
+		return defaultPersonas
+	}
+	return c.Personas
+}
+
+/* The model by name, with its provider filled in. Empty is the default. */
+func (c BotCatalog) model(name string) (CatalogModel, bool) {
+	for _, model := range c.models() {
+		if name == "" || model.Name == name {
+			if model.Provider == "" {
+				model.Provider = botProvider
+			}
+			if model.Model == "" {
+				model.Model = model.Name
+			}
+			return model, true
+		}
+	}
+	return CatalogModel{}, false
+}
+
+/* The persona by name. Empty is the standard one, or the first. */
+func (c BotCatalog) persona(name string) (Persona, bool) {
+	personas := c.personas()
+	if name == "" {
+		name = standardPersona
+		if _, found := c.persona(name); !found {
+			return personas[0], true
+		}
+	}
+	for _, persona := range personas {
+		if persona.Name == name {
+			return persona, true
+		}
+	}
+	return Persona{}, false
+}
+
+func (c BotCatalog) validate(providers map[string]ProviderConfig) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for _, model := range c.Models {
+		_, named := providers[model.Provider]
+		switch {
+		case model.Name == "":
+			errs = append(errs, fmt.Errorf("bot catalog: a model has no name"))
+		case seen["model "+model.Name]:
+			errs = append(errs, fmt.Errorf("bot catalog: model %v is listed twice", model.Name))
+		case model.Provider != "" && model.Provider != defaultProvider && !named:
+			errs = append(errs, fmt.Errorf("bot catalog: model %v: provider %v is not in the config file's providers",
+				model.Name, model.Provider))
+		}
+		seen["model "+model.Name] = true
+	}
+	for _, persona := range c.Personas {
+		switch {
+		case persona.Name == "":
+			errs = append(errs, fmt.Errorf("bot catalog: a persona has no name"))
+		case seen["persona "+persona.Name]:
+			errs = append(errs, fmt.Errorf("bot catalog: persona %v is listed twice", persona.Name))
+		}
+		seen["persona "+persona.Name] = true
+	}
+	return errs
+}
+
+type botCatalogResponse struct {
+	Models         []CatalogModel `json:"models"`
+	Personas       []Persona      `json:"personas"`
+	MaxTemperature float32        `json:"maxTemperature"`
+}
+
+/* What players may pick for bot seats: GET /bots */
+func (m *Manager) botCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := botCatalogResponse{MaxTemperature: maxTemperature}
+	for _, model := range botCatalog.models() {
+		model, _ = botCatalog.model(model.Name)
+		resp.Models = append(resp.Models, model)
+	}
+	for _, persona := range botCatalog.personas() {
+		/* The instructions are between the server and the model. */
+		persona.Prompt = ""
+		resp.Personas = append(resp.Personas, persona)
+	}
+	writeJSON(w, resp)
+}
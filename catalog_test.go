@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func temperature(t float32) *float32 {
+	return &t
+}
+
+func TestBotSeats(t *testing.T) {
+	defer func(model string, provider string) {
+		botModel, botProvider = model, provider
+	}(botModel, botProvider)
+	botModel, botProvider = "default-model", defaultProvider
+	catalog := BotCatalog{
+		Models: []CatalogModel{
+			{Name: "fast", Provider: "local", Model: "llama3"},
+			{Name: "smart"},
+		},
+	}
+	if errs := catalog.validate(map[string]ProviderConfig{"local": {}}); len(errs) != 0 {
+		t.Errorf("valid catalog: %v", errs)
+	}
+	bad := BotCatalog{Models: []CatalogModel{{Name: "fast", Provider: "nonesuch"}, {Name: "fast"}}}
+	if errs := bad.validate(nil); len(errs) != 2 {
+		t.Errorf("invalid catalog: %v", errs)
+	}
+
+	bots := BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Red: true, Blue: true},
+	}
+	for _, seats := range [][]BotSeat{
+		{{Team: red, Role: cluegiver}},
+		{{Team: blue, Role: guesser}, {Team: blue, Role: guesser}},
+		{{Team: blue, Role: guesser, Model: "nonesuch"}},
+		{{Team: blue, Role: guesser, Persona: "nonesuch"}},
+		{{Team: blue, Role: guesser, Temperature: temperature(-0.1)}},
+		{{Team: blue, Role: guesser, Temperature: temperature(2.1)}},
+	} {
+		bots.Seats = seats
+		var requestErr *RequestError
+		if _, err := bots.withSeats(catalog); !errors.As(err, &requestErr) || requestErr.Code != ErrCodeBadPayload {
+			t.Errorf("seats %+v: got %v", seats, err)
+		}
+	}
+
+	bots.Seats = []BotSeat{{Team: blue, Role: cluegiver, Model: "smart", Persona: "bold", Temperature: temperature(0)}}
+	seated, err := bots.withSeats(catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seated.Seats) != 3 {
+		t.Fatalf("seats: %+v", seated.Seats)
+	}
+	if seat, _ := seated.seat(blue, cluegiver); seat.Model != "smart" || seat.Persona != "bold" || *seat.Temperature != 0 {
+		t.Errorf("seat asked for: %+v", seat)
+	}
+	if seat, _ := seated.seat(red, guesser); seat.Model != "fast" || seat.Persona != standardPersona || seat.Temperature != nil {
+		t.Errorf("default seat: %+v", seat)
+	}
+	if model, _ := catalog.model("fast"); model.Provider != "local" || model.Model != "llama3" {
+		t.Errorf("model: %+v", model)
+	}
+	if model, _ := (BotCatalog{}).model(""); model.Provider != defaultProvider || model.Model != "default-model" {
+		t.Errorf("model without a catalog: %+v", model)
+	}
+
+	/* Settings follow the bots in a rematch. */
+	if seat, found := seated.rotateTeams().seat(red, cluegiver); !found || seat.Model != "smart" {
+		t.Errorf("rotated teams: %+v", seat)
+	}
+	if seat, found := seated.rotateRoles().seat(blue, guesser); !found || seat.Persona != "bold" {
+		t.Errorf("rotated roles: %+v", seat)
+	}
+}
+
+func TestBotCatalogHandler(t *testing.T) {
+	manager := NewManager(context.Background())
+	w := httptest.NewRecorder()
+	manager.botCatalogHandler(w, httptest.NewRequest(http.MethodGet, "/bots", nil))
+	var resp botCatalogResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Models) != 1 || resp.Models[0].Name != botModel || resp.MaxTemperature != maxTemperature ||
+		len(resp.Personas) != len(defaultPersonas) {
+		t.Errorf("catalog: %+v", resp)
+	}
+	if strings.Contains(w.Body.String(), "prompt") {
+		t.Error("catalog includes persona prompts")
+	}
+
+	w = httptest.NewRecorder()
+	manager.botCatalogHandler(w, httptest.NewRequest(http.MethodPost, "/bots", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %v", w.Code)
+	}
+}
+
+/* The room hears how each bot seat is played, and what was wrong
+   with a request. */
+func TestBotSeatNewGame(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	alice := NewClient("alice", nil, manager)
+	bob := NewClient("bob", nil, manager)
+	bob.role = cluegiver
+	manager.addClient(alice)
+	manager.addClient(bob)
+	room, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, alice)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, bob)
+
+	request := NewGameRequestEvent{Bots: BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Blue: true},
+		Seats:     []BotSeat{{Team: blue, Role: guesser, Persona: "nonesuch"}},
+	}}
+	payload, _ := json.Marshal(request)
+	manager.routeEvent(Event{Type: EventNewGame, Payload: payload}, alice)
+	var refusal string
+	json.Unmarshal(waitForEvent(t, alice, EventInvalidState).Payload, &refusal)
+	if !strings.Contains(refusal, "nonesuch") {
+		t.Errorf("refusal: %v", refusal)
+	}
+
+	request.Bots.Seats = []BotSeat{{Team: blue, Role: guesser, Persona: "cautious", Temperature: temperature(0.5)}}
+	payload, _ = json.Marshal(request)
+	manager.routeEvent(Event{Type: EventNewGame, Payload: payload}, alice)
+	var game NewGameResponseEvent
+	json.Unmarshal(waitForEvent(t, bob, EventNewGame).Payload, &game)
+	if len(game.Bots) != 2 {
+		t.Fatalf("bots: %+v", game.Bots)
+	}
+	seat := game.Bots[1].Bot
+	if game.Bots[1].Name != "ChatBot-blue-guesser" || seat == nil || seat.Persona != "cautious" ||
+		seat.Model != botModel || *seat.Temperature != 0.5 {
+		t.Errorf("bot: %+v %+v", game.Bots[1], seat)
+	}
+
+	/* Those entering later see the bots too. */
+	carol := NewClient("carol", nil, manager)
+	manager.addClient(carol)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, carol)
+	var entered ChangeRoomEvent
+	json.Unmarshal(waitForEvent(t, carol, EventEnterRoom).Payload, &entered)
+	if len(entered.Participants) != 5 || entered.Participants[3].Bot == nil {
+		t.Errorf("participants: %+v", entered.Participants)
+	}
+}
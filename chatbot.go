@@ -6,33 +6,65 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/rs/zerolog/log"
 	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+/* Name bots play under, in chat and in game logs. */
+const botName = "ChatBot"
+
+/* Model used for bot players. */
+var botModel = openai.GPT3Dot5Turbo
+
 type ClueStruct struct {
+	/* The system prompt and user message the bot was sent. */
+	prompt    string
+	message   string
 	response  string
 	numGuess  int
 	word      string
 	match     string
 	capsWords []string
 	err       error
+	/* Trace context of the Play waiting for the answer. */
+	ctx       context.Context
 }
 
 type Bot struct {
-	ctx        context.Context
-	OpenAI     *openai.Client
-	game       *Game
-	clue_chan  chan *ClueStruct
-	guess_chan chan *ClueStruct
-	actions    *BotActions
-	client     *Client
+	ctx         context.Context
+	/* How the bot plays the seat whose turn it is: set by Play. */
+	llm         LLMProvider
+	provider    string
+	model       string
+	temperature *float32
+	persona     Persona
+	game        *Game
+	clue_chan   chan *ClueStruct
+	guess_chan  chan *ClueStruct
+	actions     *BotActions
+	client      *Client
 }
 
 type BotActions struct {
 	Guesser   TeamActions `json:"guesser"`
 	Cluegiver TeamActions `json:"cluegiver"`
+	/* Settings for the seats above. Games list every bot seat. */
+	Seats     []BotSeat   `json:"seats,omitempty"`
+}
+
+/* How a bot plays one seat. */
+type BotSeat struct {
+	Team        Team     `json:"team"`
+	Role        Role     `json:"role"`
+	/* From the catalog; empty is the default model, and the
+	   standard persona. */
+	Model       string   `json:"model,omitempty"`
+	Persona     string   `json:"persona,omitempty"`
+	/* Sampling temperature, from 0 to maxTemperature; empty is the
+	   provider's default. */
+	Temperature *float32 `json:"temperature,omitempty"`
 }
 type TeamActions struct {
 	Red  bool `json:"red"`
@@ -68,14 +100,120 @@ func (ba BotActions) hasTeamAction(t Team, r Role) bool {
 	}
 }
 
+func (ba BotActions) seat(t Team, r Role) (BotSeat, bool) {
+	for _, seat := range ba.Seats {
+		if seat.Team == t && seat.Role == r {
+			return seat, true
+		}
+	}
+	return BotSeat{}, false
+}
+
+/* The bot actions with settings for every bot seat: those asked for,
+   checked against the catalog, and defaults for the others. */
+func (ba BotActions) withSeats(catalog BotCatalog) (BotActions, error) {
+	for i, seat := range ba.Seats {
+		if !ba.hasTeamAction(seat.Team, seat.Role) {
+			return ba, requestError(ErrCodeBadPayload, "no bot plays %v %v", seat.Team, seat.Role)
+		}
+		for _, other := range ba.Seats[:i] {
+			if other.Team == seat.Team && other.Role == seat.Role {
+				return ba, requestError(ErrCodeBadPayload, "bot seat %v %v is set twice", seat.Team, seat.Role)
+			}
+		}
+		if _, found := catalog.model(seat.Model); !found {
+			return ba, requestError(ErrCodeBadPayload, "unknown bot model %q", seat.Model)
+		}
+		if _, found := catalog.persona(seat.Persona); !found {
+			return ba, requestError(ErrCodeBadPayload, "unknown bot persona %q", seat.Persona)
+		}
+		if t := seat.Temperature; t != nil && (*t < 0 || *t > maxTemperature) {
+			return ba, requestError(ErrCodeBadPayload, "bot temperature must be from 0 to %v", maxTemperature)
+		}
+	}
+
+	seats := []BotSeat{}
+	for _, t := range []Team{ red, blue } {
+		for _, r := range []Role{ cluegiver, guesser } {
+			if !ba.hasTeamAction(t, r) {
+				continue
+			}
+			seat, _ := ba.seat(t, r)
+			seat.Team, seat.Role = t, r
+			model, _ := catalog.model(seat.Model)
+			persona, _ := catalog.persona(seat.Persona)
+			seat.Model, seat.Persona = model.Name, persona.Name
+			seats = append(seats, seat)
+		}
+	}
+	ba.Seats = seats
+	return ba, nil
+}
+
+/* Bots follow the same rotation as human players in a rematch,
+   and keep their settings. */
+func (ba BotActions) rotateTeams() BotActions {
+	rotated := BotActions{
+		Guesser:   TeamActions{Red: ba.Guesser.Blue, Blue: ba.Guesser.Red},
+		Cluegiver: TeamActions{Red: ba.Cluegiver.Blue, Blue: ba.Cluegiver.Red},
+	}
+	for _, seat := range ba.Seats {
+		seat.Team = seat.Team.Change()
+		rotated.Seats = append(rotated.Seats, seat)
+	}
+	return rotated
+}
+
+func (ba BotActions) rotateRoles() BotActions {
+	rotated := BotActions{
+		Guesser:   ba.Cluegiver,
+		Cluegiver: ba.Guesser,
+	}
+	for _, seat := range ba.Seats {
+		seat.Role = seat.Role.Change()
+		rotated.Seats = append(rotated.Seats, seat)
+	}
+	return rotated
+}
+
+/* Take the settings of the bot's seat on the team and role. */
+func (bot *Bot) useSeat(team Team, role Role) {
+	seat, _ := bot.actions.seat(team, role)
+	model, found := botCatalog.model(seat.Model)
+	if !found {
+		model, _ = botCatalog.model("")
+	}
+	bot.persona, found = botCatalog.persona(seat.Persona)
+	if !found {
+		bot.persona, _ = botCatalog.persona("")
+	}
+	bot.provider = model.Provider
+	bot.model = model.Model
+	bot.llm = llmProviders[model.Provider]
+	bot.temperature = seat.Temperature
+}
+
+/* The system prompt for the bot's role, in the seat's persona. */
+func (bot *Bot) system(prompt string) string {
+	if bot.persona.Prompt == "" {
+		return prompt
+	}
+	return prompt + " " + bot.persona.Prompt
+}
+
 func NewBot(game *Game, ba *BotActions) *Bot {
+	/* Bot calls are cancelled when the manager shuts down. */
+	ctx := context.TODO()
+	if game.manager != nil {
+		ctx = game.manager.ctx
+	}
 	b := &Bot{
-		ctx:     context.TODO(),
-		OpenAI:  openai.NewClient(token),
+		ctx:     ctx,
 		game:    game,
 		actions: ba,
 		client:  &Client{game: game,},
 	}
+	b.useSeat(red, cluegiver)
 
 	if ba.hasAction(cluegiver) {
 		b.clue_chan = b.makeClue()
@@ -101,8 +239,12 @@ func (bot *Bot) Play(clue GiveClueEvent) (string, *ClueStruct, Team, Role) {
 	if bot.actions.hasTeamAction(team, role) {
 		bot.client.team = team
 		bot.client.role = role
+		bot.useSeat(team, role)
+		ctx, end := game.startSpan("Bot.Play", attrTeam.String(team.String()),
+			attrRole.String(role.String()))
 		clueStruct := &ClueStruct{
 			capsWords: make([]string, 0),
+			ctx:       ctx,
 		}
 		eventName := ""
 		switch role {
@@ -141,34 +283,65 @@ func (bot *Bot) Play(clue GiveClueEvent) (string, *ClueStruct, Team, Role) {
 			}
 			clueStruct =<-bot.guess_chan
 		}
+		end(clueStruct.err)
 		return eventName, clueStruct, team, role
 	}
 	return "", nil, team, role
 }
 
-/* Real call to OpenAI ChatGPT. Function stored in a var so it
-   can be overridden for testing. */
-var askGPT3Dot5Bot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
-	return bot.OpenAI.CreateChatCompletion(
-		bot.ctx,
-		openai.ChatCompletionRequest{
-			Model: openai.GPT3Dot5Turbo,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: system,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: user,
-				},
-			},
-		},
-	)
+/* Call to the bot's LLM provider, stored in a var so it can be
+   overridden for testing. */
+var askLLMBot = askProvider
+
+/* Real call to the bot's LLM provider. */
+func askProvider(bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+	if bot.llm == nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("no LLM provider %q", bot.provider)
+	}
+	return bot.llm.Chat(bot.ctx, LLMRequest{
+		Model:       bot.model,
+		System:      system,
+		User:        user,
+		Temperature: bot.temperature,
+	})
 }
 
-func (bot *Bot) askGPT3Dot5(system string, user string) (openai.ChatCompletionResponse, error) {
-	return askGPT3Dot5Bot(bot, system, user)
+/* Calls in flight are counted so shutdown can wait for them,
+   and timed along with the tokens they use. */
+func (bot *Bot) askLLM(ctx context.Context, system string, user string) (openai.ChatCompletionResponse, error) {
+	attrs := []attribute.KeyValue{attrModel.String(bot.model)}
+	if bot.game != nil {
+		attrs = append(attrs, attrGame.String(bot.game.id))
+	}
+	_, span := startSpan(ctx, "llm.request", attrs...)
+	if bot.game == nil || bot.game.manager == nil {
+		resp, err := askLLMBot(bot, system, user)
+		endSpan(span, err)
+		return resp, err
+	}
+	m := bot.game.manager
+	m.botCalls.Add(1)
+	defer m.botCalls.Add(-1)
+
+	start := time.Now()
+	resp, err := askLLMBot(bot, system, user)
+	took := time.Since(start)
+	m.metrics.llmCall(bot.model, took, resp, err)
+	if err == nil {
+		/* Read by the room's goroutine once Play has the answer. */
+		bot.game.usage.add(resp.Usage)
+		m.usage.record(bot.game.name, resp.Usage, time.Now())
+		bot.game.log.Info().Str("model", bot.model).Dur("took", took).
+			Int("promptTokens", resp.Usage.PromptTokens).
+			Int("completionTokens", resp.Usage.CompletionTokens).
+			Msg("LLM call")
+	}
+	span.SetAttributes(
+		attribute.Int("llm.tokens.prompt", resp.Usage.PromptTokens),
+		attribute.Int("llm.tokens.completion", resp.Usage.CompletionTokens),
+	)
+	endSpan(span, err)
+	return resp, err
 }
 
 func (bot *Bot) makeClue() chan *ClueStruct {
@@ -188,36 +361,43 @@ func (bot *Bot) makeClue() chan *ClueStruct {
 		for {
 			clue, ok := <-c
 			if !ok {
-				log.Error().Msg("clue channel error")
+				bot.game.log.Error().Msg("clue channel error")
 				break
 			}
 
+			/* On errors, reply anyway: Play is waiting
+			   for the answer on the room's goroutine. */
 			w := bot.game.cards.getClueWords(bot.game.teamTurn)
 			if len(w.myTeam) == 0 || len(w.others) == 0 {
-				log.Error().Msg("makeClue error: got zero-length word list")
-				break
+				clue.err = fmt.Errorf("makeClue error: got zero-length word list")
+				c <- clue
+				continue
 			}
 
 			message := fmt.Sprintf("Your team's list: %s. Opposing team's list: %s.",
 				w.myTeam, w.others)
+			clue.prompt, clue.message = bot.system(prompt), message
 
-			resp, err := bot.askGPT3Dot5(prompt, message)
+			resp, err := bot.askLLM(clue.ctx, clue.prompt, message)
 			if err != nil {
-				log.Error().Err(err)
-				break
+				clue.err = fmt.Errorf("ChatCompletion error: %v", err)
+				c <- clue
+				continue
 			}
 			respStr := resp.Choices[0].Message.Content
+			_, span := startSpan(clue.ctx, "llm.parse", attrGame.String(bot.game.id))
 			parseGPTResponse(respStr, clue)
-			if verbose {
-				log.Info().
-					Str("botType", "cluegiver").
-					Str("teamWords", w.myTeam).
-					Str("otherWords", w.others).
-					Str("clue", clue.word).
-					Int("numGuess", clue.numGuess).
-					Str("match", clue.match).
-					Msg(respStr)
-			}
+			span.SetAttributes(attribute.String("clue", clue.word),
+				attribute.Int("numGuess", clue.numGuess))
+			endSpan(span, nil)
+			bot.game.log.Debug().
+				Str("botType", "cluegiver").
+				Str("teamWords", w.myTeam).
+				Str("otherWords", w.others).
+				Str("clue", clue.word).
+				Int("numGuess", clue.numGuess).
+				Str("match", clue.match).
+				Msg(respStr)
 			c <- clue
 		}
 	}(bot)
@@ -383,29 +563,33 @@ func (bot *Bot) makeGuess() chan *ClueStruct {
 			words := bot.game.cards.getGuessWords()
 			if len(words) == 0 {
 				clue.err = fmt.Errorf("makeGuess error: got zero-length word list")
-				break
+				c <- clue
+				continue
 			}
 
 			message := fmt.Sprintf(
 				"The word list is: %s. The clue is: %s. The number is: %d",
 				words, clue.word, clue.numGuess)
+			clue.prompt, clue.message = bot.system(prompt), message
 
-			resp, err := bot.askGPT3Dot5(prompt, message)
+			resp, err := bot.askLLM(clue.ctx, clue.prompt, message)
 			if err != nil {
 				clue.err = fmt.Errorf("ChatCompletion error: %v", err)
-				break
+				c <- clue
+				continue
 			}
 			clue.response = resp.Choices[0].Message.Content
+			_, span := startSpan(clue.ctx, "llm.parse", attrGame.String(bot.game.id))
 			clue.capsWords, clue.err = findGuessWords(clue.response)
-			if verbose {
-				log.Info().
-					Str("botType", "guesser").
-					Str("words", words).
-					Str("clue", clue.word).
-					Int("numGuess", clue.numGuess).
-					Str("guess", strings.Join(clue.capsWords, ",")).
-					Msg(clue.response)
-			}
+			span.SetAttributes(attribute.StringSlice("guesses", clue.capsWords))
+			endSpan(span, clue.err)
+			bot.game.log.Debug().
+				Str("botType", "guesser").
+				Str("words", words).
+				Str("clue", clue.word).
+				Int("numGuess", clue.numGuess).
+				Str("guess", strings.Join(clue.capsWords, ",")).
+				Msg(clue.response)
 			c <- clue
 		}
 	}(bot)
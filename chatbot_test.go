@@ -221,7 +221,7 @@ func TestMakeClueReal(t *testing.T) {
 		t.Skip("Real ChatGPT test skipped in short mode")
 	}
 
-	token = getGPTToken("gpt-secretkey.txt")
+	llmProviders[defaultProvider], _ = NewOpenAIProvider(ProviderConfig{KeyFile: "gpt-secretkey.txt"})
 	ba := &BotActions{
 		Cluegiver: TeamActions{
 			Red: true,
@@ -299,7 +299,7 @@ func TestMakeClueMock(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		askGPT3Dot5Bot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+		askLLMBot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
 			return openai.ChatCompletionResponse{
 				Choices: []openai.ChatCompletionChoice{
 					{
@@ -340,7 +340,7 @@ func TestMakeGuessReal(t *testing.T) {
 		t.Skip("Real ChatGPT test skipped in short mode")
 	}
 	
-	token = getGPTToken("gpt-secretkey.txt")
+	llmProviders[defaultProvider], _ = NewOpenAIProvider(ProviderConfig{KeyFile: "gpt-secretkey.txt"})
 	ba := &BotActions{
 		Guesser: TeamActions{
 			Red: true,
@@ -382,7 +382,7 @@ func TestMakeGuessMock(t *testing.T) {
 
 	response := "The three words from the word list that best match " +
 			    "the clue \"Measure\" are:\n1. SCALE\n2. RULER\n3. TAPE"
-	askGPT3Dot5Bot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+	askLLMBot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
 		return openai.ChatCompletionResponse{
 			Choices: []openai.ChatCompletionChoice{
 				{
@@ -421,7 +421,7 @@ func TestBotPlayCluegiver(t *testing.T) {
 	response := "Clue: Measure\nNumber of words that " +
 		"match the clue: 3\nWords that match the clue: " +
 		"SCALE, WATCH, MAPLE"
-	askGPT3Dot5Bot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+	askLLMBot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
 		return openai.ChatCompletionResponse{
 			Choices: []openai.ChatCompletionChoice{
 				{
@@ -467,7 +467,7 @@ func TestBotPlayGuesser(t *testing.T) {
 	}
 	response := "The three words from the word list that best match " +
 			    "the clue \"Measure\" are:\n1. SCALE\n2. RULER\n3. TAPE"
-	askGPT3Dot5Bot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+	askLLMBot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
 		return openai.ChatCompletionResponse{
 			Choices: []openai.ChatCompletionChoice{
 				{
@@ -2,23 +2,59 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var (
 	pongWait     = 10 * time.Second
 	pingInterval = 5 * time.Second
+
+	/* Largest message accepted from a client, in bytes. */
+	readLimit int64 = 512
+
+	/* Outbound messages queued per client, and what to do
+	   when a client falls that far behind. */
+	egressBuffer = 64
+	egressPolicy = EgressDisconnect
+)
+
+/* What to do with a message for a client whose queue is full. */
+type EgressPolicy string
+const (
+	/* Discard the new message. */
+	EgressDrop       EgressPolicy = "drop"
+	/* Discard the oldest queued message to make room for the new one. */
+	EgressDropOldest EgressPolicy = "drop_oldest"
+	/* Discard the new message and close the client's connection. */
+	EgressDisconnect EgressPolicy = "disconnect"
 )
 
+func NewEgressPolicy(s string) (EgressPolicy, error) {
+	switch p := EgressPolicy(s); p {
+	case EgressDrop, EgressDropOldest, EgressDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid egress policy: %s", s)
+	}
+}
+
 type Participant struct {
-	Name   string  `json:"name"`
-	Team   Team    `json:"teamColor"`
-	Role   Role    `json:"role"`
-	InGame bool    `json:"inGame"`
+	Name       string `json:"name"`
+	Team       Team   `json:"teamColor"`
+	Role       Role   `json:"role"`
+	InGame     bool   `json:"inGame"`
+	/* Logged in to an account rather than as a guest. */
+	Registered bool   `json:"registered,omitempty"`
+	/* Set for bots: the seat's model, persona and temperature. */
+	Bot        *BotSeat `json:"bot,omitempty"`
 }
 
 type ClientList map[string]*Client
@@ -36,6 +72,7 @@ func (cl ClientList) listClients() []Participant {
 			Team: client.team,
 			Role: client.role,
 			InGame: inGame,
+			Registered: client.registered,
 		}
 		i++
 	}
@@ -45,8 +82,6 @@ func (cl ClientList) listClients() []Participant {
 	return participants
 }
 
-type ChatRooms map[string]ClientList
-
 type Client struct {
 	connection *websocket.Conn
 	manager    *Manager
@@ -55,9 +90,39 @@ type Client struct {
 	chatroom   string
 	team       Team
 	role       Role
+	registered bool
+	/* Address the client connected from, for bans. */
+	addr       string
+	budget     eventBudget
+	/* Logs with the user name; see logger and eventLogger. */
+	log        zerolog.Logger
 
 	// egress is used to avoid concurrent writes on the websocket connection
 	egress chan Event
+	// sendMu numbers events in the order they are queued.
+	sendMu sync.Mutex
+	seq    uint64
+	dropped atomic.Uint64
+	evicted sync.Once
+	// closing asks writeMessages to send what is queued and then a
+	// close frame; done is closed once writeMessages returns.
+	closing   chan closeRequest
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// mu guards chatroom and removed. chatroom is changed on the
+	// room's goroutine but read by the client's own goroutines.
+	mu      sync.Mutex
+	removed bool
+
+	// For a client of another instance: the instance it is
+	// connected to, which gets everything sent to the client.
+	home string
+	// Publishes what is sent to the client in order, so the room never
+	// waits on the broker.
+	outbox *taskQueue
+	// Replies from other instances when the client leaves their rooms.
+	left chan Envelope
 }
 
 func NewClient(username string, conn *websocket.Conn, manager *Manager) *Client {
@@ -67,10 +132,23 @@ func NewClient(username string, conn *websocket.Conn, manager *Manager) *Client
 		username:   username,
 		role:       guesser,
 		team:       red,
-		egress:     make(chan Event),
+		egress:     make(chan Event, egressBuffer),
+		closing:    make(chan closeRequest, 1),
+		done:       make(chan struct{}),
+		left:       make(chan Envelope, 1),
+		log:        log.With().Str("user", username).Logger(),
 	}
 }
 
+/* A client connected to another instance, in a room owned by this one. */
+func NewRemoteClient(username string, home string, manager *Manager) *Client {
+	c := NewClient(username, nil, manager)
+	c.home = home
+	c.outbox = newTaskQueue()
+	c.log = c.log.With().Str("home", home).Logger()
+	return c
+}
+
 func (c *Client) readMessages() {
 	defer func() {
 		// cleanup connection
@@ -79,21 +157,21 @@ func (c *Client) readMessages() {
 
 	// Heartbeats
 	if err := c.connection.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-		log.Error().Err(err)
+		c.log.Error().Err(err).Msg("could not set read deadline")
 		return
 	}
 	c.connection.SetPongHandler(c.pongHandler)
 
 	// Fix for jumbo frame (don't let people overflow buffer)
 	// This will close connection with the offending client
-	c.connection.SetReadLimit(512)
+	c.connection.SetReadLimit(readLimit)
 
 	for {
 		_, payload, err := c.connection.ReadMessage()
 
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error reading message: %v", err)
+				c.logger().Warn().Err(err).Msg("error reading message")
 			}
 			break
 		}
@@ -101,17 +179,17 @@ func (c *Client) readMessages() {
 		var request Event
 
 		if err := json.Unmarshal(payload, &request); err != nil {
-			log.Error().Err(err).Msg("error unmarshalling event")
+			c.logger().Warn().Err(err).Msg("error unmarshalling event")
 			break
 		}
 
-		if err := c.manager.routeEvent(request, c); err != nil {
-			log.Error().Str("event", request.Type).Err(err)
-		}
+		/* routeEvent logs errors and reports them to the client. */
+		c.manager.routeEvent(request, c)
 	}
 }
 
 func (c *Client) writeMessages() {
+	defer close(c.done)
 	defer func() {
 		c.manager.removeClient(c)
 	}()
@@ -121,36 +199,144 @@ func (c *Client) writeMessages() {
 
 	for {
 		select {
-		case message, ok := <-c.egress:
-			if !ok {
-				if err := c.connection.WriteMessage(websocket.CloseMessage, nil); err != nil {
-					log.Error().Err(err).Msg("error closing websocket")
-				}
-				return
-			}
-
-			data, err := json.Marshal(message)
-			if err != nil {
-				log.Error().Err(err)
+		case message := <-c.egress:
+			if !c.writeEvent(message) {
 				return
 			}
 
-			if err := c.connection.WriteMessage(websocket.TextMessage, data); err != nil {
-				log.Error().Err(err).Msg("failed to send TextMessage over websocket")
-			}
+		case req := <-c.closing:
+			c.flush(req)
+			return
 
 		// Heartbeats
 		case <-ticker.C:
 			// Send a Ping to the Client
 			if err := c.connection.WriteMessage(websocket.PingMessage, []byte(``)); err != nil {
-				log.Error().Err(err).Msg("failed to send PingMessage over websocket")
+				c.log.Error().Err(err).Msg("failed to send PingMessage over websocket")
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) room() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.chatroom
+}
+
+/* Returns false if the writer should stop. */
+func (c *Client) writeEvent(message Event) bool {
+	data, err := json.Marshal(message)
+	if err != nil {
+		c.log.Error().Err(err).Str("event", message.Type).Msg("could not marshal event")
+		return false
+	}
+
+	if err := c.connection.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.log.Error().Err(err).Msg("failed to send TextMessage over websocket")
+	}
+	return true
+}
+
+/* Send whatever is queued for the client, then a close frame, giving
+   up at the request's deadline. */
+func (c *Client) flush(req closeRequest) {
+	c.connection.SetWriteDeadline(req.deadline)
+	for {
+		select {
+		case message := <-c.egress:
+			if !c.writeEvent(message) {
 				return
 			}
+		default:
+			msg := websocket.FormatCloseMessage(req.code, req.reason)
+			if err := c.connection.WriteMessage(websocket.CloseMessage, msg); err != nil {
+				c.log.Error().Err(err).Msg("could not send close frame")
+			}
+			return
+		}
+	}
+}
+
+/* Queue an event for the client without ever blocking, so one slow
+   client cannot hold up a room. A full queue is handled according
+   to egressPolicy. */
+func (c *Client) send(event Event) {
+	if c.home != "" {
+		c.outbox.post(func() {
+			err := c.manager.forward(c.home, Envelope{
+				Kind:  EnvelopeDeliver,
+				User:  c.username,
+				Event: event,
+			})
+			if err != nil {
+				c.log.Error().Err(err).Msg("could not forward message")
+			}
+		})
+		return
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	/* Dropped events keep their numbers, so the client sees the gap. */
+	c.seq++
+	event.Seq = c.seq
+
+	select {
+	case c.egress <- event:
+		return
+	default:
+	}
+
+	switch egressPolicy {
+	case EgressDropOldest:
+		select {
+		case <-c.egress:
+		default:
+		}
+		c.drop()
+		select {
+		case c.egress <- event:
+		default:
+			/* Someone else took the free slot. */
+			c.drop()
 		}
+	case EgressDisconnect:
+		c.drop()
+		c.evict()
+	default:
+		c.drop()
 	}
 }
 
+func (c *Client) drop() {
+	if c.dropped.Add(1) == 1 {
+		c.log.Warn().Msg("outbound queue full, dropping messages")
+	}
+	c.manager.droppedMessages.Add(1)
+}
+
+/* Close the connection of a client that cannot keep up. Its
+   readMessages goroutine then fails and removes the client. */
+func (c *Client) evict() {
+	c.evicted.Do(func() {
+		c.log.Warn().Uint64("dropped", c.dropped.Load()).
+			Msg("evicting slow client")
+		c.manager.evictedClients.Add(1)
+		if c.connection != nil {
+			c.connection.Close()
+		}
+	})
+}
+
 // Heartbeats - reset the timer
 func (c *Client) pongHandler(pongMsg string) error {
+	if c.connection == nil {
+		/* A client of another instance. */
+		return nil
+	}
 	return c.connection.SetReadDeadline(time.Now().Add(pongWait))
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientSend(t *testing.T) {
+	defer func(size int, policy EgressPolicy) {
+		egressBuffer, egressPolicy = size, policy
+	}(egressBuffer, egressPolicy)
+	egressBuffer = 2
+
+	manager := NewManager(context.Background())
+	event := func(msg string) Event {
+		return Event{Type: EventNewMessage, Payload: []byte(`"` + msg + `"`)}
+	}
+	queued := func(c *Client) []string {
+		msgs := []string{}
+		for len(c.egress) > 0 {
+			e := <-c.egress
+			msgs = append(msgs, string(e.Payload))
+		}
+		return msgs
+	}
+
+	egressPolicy = EgressDrop
+	client := NewClient("drop", nil, manager)
+	for _, msg := range []string{"1", "2", "3"} {
+		client.send(event(msg))
+	}
+	if msgs := queued(client); len(msgs) != 2 || msgs[1] != `"2"` {
+		t.Errorf("drop policy should keep the first messages, got %v", msgs)
+	}
+	if client.dropped.Load() != 1 {
+		t.Errorf("expected 1 dropped message, got %v", client.dropped.Load())
+	}
+
+	egressPolicy = EgressDropOldest
+	client = NewClient("dropOldest", nil, manager)
+	for _, msg := range []string{"1", "2", "3"} {
+		client.send(event(msg))
+	}
+	if msgs := queued(client); len(msgs) != 2 || msgs[0] != `"2"` || msgs[1] != `"3"` {
+		t.Errorf("drop_oldest policy should keep the latest messages, got %v", msgs)
+	}
+
+	egressPolicy = EgressDisconnect
+	client = NewClient("disconnect", nil, manager)
+	for _, msg := range []string{"1", "2", "3", "4"} {
+		client.send(event(msg))
+	}
+	if manager.evictedClients.Load() != 1 {
+		t.Errorf("expected 1 evicted client, got %v", manager.evictedClients.Load())
+	}
+	if manager.droppedMessages.Load() != 4 {
+		t.Errorf("expected 4 dropped messages in total, got %v", manager.droppedMessages.Load())
+	}
+
+	if _, err := NewEgressPolicy("coalesce"); err == nil {
+		t.Error("unknown egress policy accepted")
+	}
+}
+
+/* Closing sends what is queued, then the close frame, without waiting
+   out the deadline. */
+func TestClientClose(t *testing.T) {
+	manager := NewManager(context.Background())
+	closed := make(chan time.Duration, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocketUpgrader.CheckOrigin = func(r *http.Request) bool { return true }
+		conn, err := websocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := NewClient("alice", conn, manager)
+		manager.addClient(c)
+		for i := 0; i < 3; i++ {
+			c.send(Event{Type: EventNewMessage})
+		}
+		go c.writeMessages()
+		start := time.Now()
+		c.close(websocket.CloseServiceRestart, "bye", start.Add(5*time.Second))
+		closed <- time.Since(start)
+	}))
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for i := 0; i < 3; i++ {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatalf("message %v: %v", i, err)
+		}
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Errorf("expected a close frame, got %v", err)
+	}
+	if took := <-closed; took > time.Second {
+		t.Errorf("close took %v", took)
+	}
+}
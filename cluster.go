@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+/* Running several server instances.
+
+   Every chat room is owned by one instance, the first to claim it
+   through the broker, and its clients and game live there. A client
+   connected to another instance (its home) is represented at the
+   owner by a remote client: its events are forwarded from home to the
+   owner, and everything the owner sends to the remote client is
+   published back to home, which writes it to the websocket.
+
+   A room's state is lost if its owner stops; the next instance to
+   claim the room starts it afresh. */
+
+/* Claims last this long unless renewed. */
+const ownershipTTL = 30 * time.Second
+
+/* How long to wait for another instance to let a client leave a room. */
+const leaveTimeout = 5 * time.Second
+
+/* How long a room's owner is remembered, well within a claim's ttl so
+   that rooms owned here are claimed again before their claims lapse. */
+const ownerCacheTTL = ownershipTTL / 3
+
+/* Instances announce the rooms they give up on this topic, so that
+   the others forget who owned them. */
+const releasedTopic = "rooms.released"
+
+const replacedMessage = "You have connected again from somewhere else."
+
+/* Kinds of envelopes. */
+const (
+	/* home -> owner: a client event for a room. */
+	EnvelopeEvent   = "event"
+	/* home -> owner: a client enters a room. */
+	EnvelopeEnter   = "enter"
+	/* home -> owner: a client leaves a room, or disconnects. */
+	EnvelopeLeave   = "leave"
+	/* owner -> home: the client has left, with its team and role. */
+	EnvelopeLeft    = "left"
+	/* owner -> home: an event for the client's websocket. */
+	EnvelopeDeliver = "deliver"
+	/* new home -> old home: the user connected to the new home, so
+	   the old session ends. */
+	EnvelopeReplaced = "replaced"
+)
+
+/* A message between instances, published on the receiving
+   instance's topic. */
+type Envelope struct {
+	Kind       string `json:"kind"`
+	From       string `json:"from"`
+	Room       string `json:"room,omitempty"`
+	User       string `json:"user"`
+	Team       Team   `json:"team,omitempty"`
+	Role       Role   `json:"role,omitempty"`
+	Registered bool   `json:"registered,omitempty"`
+	Disconnect bool   `json:"disconnect,omitempty"`
+	Event      Event  `json:"event"`
+}
+
+func instanceTopic(id string) string {
+	return "instance." + id
+}
+
+func roomClaim(room string) string {
+	return "room." + room
+}
+
+func userClaim(username string) string {
+	return "user." + username
+}
+
+func (m *Manager) forward(instance string, env Envelope) error {
+	env.From = m.id
+	data, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("could not marshal %v envelope: %v", env.Kind, err)
+	}
+	return m.broker.Publish(instanceTopic(instance), data)
+}
+
+/* Room owners as last claimed, so that client events don't each cost
+   a round trip to the broker. */
+type ownerCache struct {
+	sync.Mutex
+	owners map[string]cachedOwner
+}
+
+type cachedOwner struct {
+	owner   string
+	expires time.Time
+}
+
+func (c *ownerCache) get(room string, now time.Time) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	cached, exists := c.owners[room]
+	if !exists || !now.Before(cached.expires) {
+		return "", false
+	}
+	return cached.owner, true
+}
+
+func (c *ownerCache) set(room string, owner string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.owners[room] = cachedOwner{owner: owner, expires: now.Add(ownerCacheTTL)}
+	/* Forget owners that have expired, so the map doesn't grow. */
+	for name, cached := range c.owners {
+		if !now.Before(cached.expires) {
+			delete(c.owners, name)
+		}
+	}
+}
+
+func (c *ownerCache) forget(room string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.owners, room)
+}
+
+/* The instance that owns the room, claiming it if nobody does. */
+func (m *Manager) ownerOf(room string) string {
+	now := time.Now()
+	if owner, cached := m.owners.get(room, now); cached {
+		return owner
+	}
+	owner, err := m.broker.Claim(roomClaim(room), m.id, ownershipTTL)
+	if err != nil {
+		/* Without the broker, serve the room here. */
+		log.Error().Err(err).Str("room", room).Msg("could not claim chat room")
+		return m.id
+	}
+	m.owners.set(room, owner, now)
+	return owner
+}
+
+/* Give up this instance's claim on the room, and tell the others. */
+func (m *Manager) releaseRoom(room string) {
+	m.owners.forget(room)
+	m.broker.Release(roomClaim(room), m.id)
+	if err := m.broker.Publish(releasedTopic, []byte(room)); err != nil {
+		log.Error().Err(err).Str("room", room).Msg("could not announce released chat room")
+	}
+}
+
+/* Another instance gave up the room, which the next to use it claims. */
+func (m *Manager) released(data []byte) {
+	m.owners.forget(string(data))
+}
+
+/* End the user's session here, if there is one: they have connected
+   again, here or at another instance. The old client leaves its room
+   now, before the new one can enter it, and keeps no claim on the
+   name. */
+func (m *Manager) endSession(username string) {
+	m.Lock()
+	client, exists := m.clients[username]
+	if exists {
+		delete(m.clients, username)
+	}
+	m.Unlock()
+	if !exists {
+		return
+	}
+	client.log.Info().Msg("connected again elsewhere")
+	m.leaveRoom(client)
+	client.sendResponse(EventServerNotice, "", ServerNoticeEvent{Message: replacedMessage})
+	go client.close(websocket.CloseNormalClosure, "connected elsewhere", time.Now().Add(time.Second))
+}
+
+/* Keep this instance's claims on its rooms and users alive. */
+func (m *Manager) renewClaims() {
+	ticker := time.NewTicker(ownershipTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.RLock()
+			rooms := make([]string, 0, len(m.chats))
+			for name := range m.chats {
+				rooms = append(rooms, name)
+			}
+			users := make([]string, 0, len(m.clients))
+			for name := range m.clients {
+				users = append(users, name)
+			}
+			m.RUnlock()
+
+			for _, name := range rooms {
+				if _, err := m.broker.Claim(roomClaim(name), m.id, ownershipTTL); err != nil {
+					log.Error().Err(err).Str("room", name).Msg("could not renew chat room")
+				}
+			}
+			for _, name := range users {
+				if _, err := m.broker.Claim(userClaim(name), m.id, ownershipTTL); err != nil {
+					log.Error().Err(err).Str("user", name).Msg("could not renew user name")
+				}
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+/* Give up this instance's claims, so others can take over at once. */
+func (m *Manager) releaseClaims() {
+	m.RLock()
+	defer m.RUnlock()
+
+	for name := range m.chats {
+		m.releaseRoom(name)
+	}
+	for name := range m.clients {
+		m.broker.Release(userClaim(name), m.id)
+	}
+}
+
+/* Move a client to another room when either room is owned by
+   another instance. Returns false if both are local, leaving the
+   move to ChatRoomHandler. Runs on the client's readMessages
+   goroutine, which is the only one moving the client. */
+func (m *Manager) moveClient(ctx context.Context, event Event, c *Client) (bool, error) {
+	var changeroom ChangeRoomEvent
+	if err := json.Unmarshal(event.Payload, &changeroom); err != nil {
+		return false, nil
+	}
+	oldroom := c.room()
+	newroom := changeroom.RoomName
+	if oldroom == newroom {
+		return false, nil
+	}
+
+	oldOwner := m.id
+	if oldroom != "" {
+		oldOwner = m.ownerOf(oldroom)
+	}
+	newOwner := m.ownerOf(newroom)
+	if oldOwner == m.id && newOwner == m.id {
+		return false, nil
+	}
+
+	if newOwner == m.id {
+		if err := m.allowNewRoom(c, newroom); err != nil {
+			return true, err
+		}
+	}
+
+	/* Leave the old room. */
+	if oldOwner == m.id {
+		/* The room may close before the task is queued, in which
+		   case the client has left it already. */
+		for room := m.room(oldroom); room != nil; room = m.room(oldroom) {
+			err := room.do(func() error {
+				return room.handle(ctx, event, func() error {
+					m.exitRoom(room, c, event.Payload)
+					return nil
+				})
+			})
+			if err != errQueueClosed {
+				break
+			}
+		}
+	} else {
+		left, err := m.leaveRemote(oldOwner, oldroom, event, c)
+		if err != nil {
+			return true, err
+		}
+		c.team, c.role = left.Team, left.Role
+	}
+
+	/* Enter the new one, unless the client disconnected meanwhile. */
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removed {
+		return true, nil
+	}
+	c.chatroom = newroom
+	if newOwner == m.id {
+		m.postToRoom(newroom, func(room *Room) {
+			err := room.handle(ctx, event, func() error {
+				return enterRoom(room, changeroom, c)
+			})
+			if err != nil {
+				c.eventLogger(event).Error().Err(err).Msg("could not enter chat room")
+			}
+		})
+		return true, nil
+	}
+	return true, m.forward(newOwner, Envelope{
+		Kind:       EnvelopeEnter,
+		Room:       newroom,
+		User:       c.username,
+		Team:       c.team,
+		Role:       c.role,
+		Registered: c.registered,
+		Event:      event,
+	})
+}
+
+func (m *Manager) leaveRemote(owner string, room string, event Event, c *Client) (Envelope, error) {
+	/* Drop any stale reply. */
+	select {
+	case <-c.left:
+	default:
+	}
+
+	err := m.forward(owner, Envelope{
+		Kind:  EnvelopeLeave,
+		Room:  room,
+		User:  c.username,
+		Event: event,
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	select {
+	case left := <-c.left:
+		return left, nil
+	case <-time.After(leaveTimeout):
+		return Envelope{}, fmt.Errorf("timed out leaving chat room %v", room)
+	}
+}
+
+/* The remote client for a user at another instance, if there is one. */
+func (m *Manager) remoteClient(username string) *Client {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.remote[username]
+}
+
+/* Handle an envelope from another instance. Runs on the broker's
+   goroutine, so it only queues work for the rooms. */
+func (m *Manager) receive(data []byte) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		log.Error().Err(err).Msg("bad envelope from broker")
+		return
+	}
+
+	switch env.Kind {
+	case EnvelopeReplaced:
+		m.endSession(env.User)
+
+	case EnvelopeDeliver, EnvelopeLeft:
+		m.RLock()
+		client, exists := m.clients[env.User]
+		m.RUnlock()
+		if !exists {
+			return
+		}
+		if env.Kind == EnvelopeDeliver {
+			client.send(env.Event)
+			return
+		}
+		select {
+		case client.left <- env:
+		default:
+		}
+
+	case EnvelopeEnter:
+		var changeroom ChangeRoomEvent
+		if err := json.Unmarshal(env.Event.Payload, &changeroom); err != nil {
+			log.Error().Err(err).Str("user", env.User).Msg("bad enter_room from another instance")
+			return
+		}
+		client := NewRemoteClient(env.User, env.From, m)
+		client.team, client.role = env.Team, env.Role
+		client.registered = env.Registered
+		client.chatroom = env.Room
+		m.Lock()
+		m.remote[env.User] = client
+		m.Unlock()
+
+		m.postToRoom(env.Room, func(room *Room) {
+			err := room.handle(context.Background(), env.Event, func() error {
+				return enterRoom(room, changeroom, client)
+			})
+			if err != nil {
+				client.eventLogger(env.Event).Error().Err(err).Msg("could not enter chat room")
+			}
+		})
+
+	case EnvelopeEvent, EnvelopeLeave:
+		client := m.remoteClient(env.User)
+		queued := client != nil && m.postToOpenRoom(env.Room, func(room *Room) {
+			if client.chatroom != room.name {
+				return
+			}
+			if env.Kind == EnvelopeEvent {
+				room.handle(context.Background(), env.Event, func() error {
+					m.handleRemoteEvent(env.Event, client)
+					return nil
+				})
+				return
+			}
+			m.exitRoom(room, client, env.Event.Payload)
+			m.Lock()
+			if m.remote[env.User] == client {
+				delete(m.remote, env.User)
+			}
+			m.Unlock()
+			if !env.Disconnect {
+				/* After whatever the room sent the client before it left. */
+				left := Envelope{
+					Kind: EnvelopeLeft,
+					User: client.username,
+					Team: client.team,
+					Role: client.role,
+				}
+				client.outbox.post(func() {
+					m.forward(client.home, left)
+				})
+			}
+		})
+		if !queued {
+			log.Warn().Str("user", env.User).Str("room", env.Room).Str("kind", env.Kind).
+				Msg("envelope for a client not in a room here")
+		}
+
+	default:
+		log.Error().Str("kind", env.Kind).Msg("unknown envelope")
+	}
+}
+
+/* Runs on the room's goroutine. */
+func (m *Manager) handleRemoteEvent(event Event, c *Client) {
+	handler, ok := m.handlers[event.Type]
+	if !ok {
+		c.respond(event, requestError(ErrCodeUnknownEvent, "there is no such event type: %v", event.Type))
+		return
+	}
+	c.respond(event, handler(event, c))
+}
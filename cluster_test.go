@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* The next event of the given type queued for the client. */
+func waitForEvent(t *testing.T, c *Client, eventType string) Event {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-c.egress:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("%v: timed out waiting for %v", c.username, eventType)
+			return Event{}
+		}
+	}
+}
+
+/* Two instances sharing one broker: alice is connected to A and bob
+   to B, and they play in a room owned by A. */
+func TestSharedRoom(t *testing.T) {
+	readWordList("./wordlist.txt")
+	ctx := context.Background()
+	broker := NewLocalBroker()
+	managerA, err := NewManagerWithBroker(ctx, broker, "A", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managerB, err := NewManagerWithBroker(ctx, broker, "B", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := NewClient("alice", nil, managerA)
+	managerA.addClient(alice)
+	bob := NewClient("bob", nil, managerB)
+	managerB.addClient(bob)
+
+	route := func(m *Manager, c *Client, eventType string, payload any) {
+		t.Helper()
+		data, _ := json.Marshal(payload)
+		if err := m.routeEvent(Event{Type: eventType, Payload: data}, c); err != nil {
+			t.Fatalf("%v: %v failed: %v", c.username, eventType, err)
+		}
+	}
+
+	route(managerA, alice, EventEnterRoom, ChangeRoomEvent{UserName: "alice", RoomName: "den"})
+	waitForEvent(t, alice, EventEnterRoom)
+
+	route(managerB, bob, EventEnterRoom, ChangeRoomEvent{UserName: "bob", RoomName: "den"})
+	var entered ChangeRoomEvent
+	json.Unmarshal(waitForEvent(t, bob, EventEnterRoom).Payload, &entered)
+	if len(entered.Participants) != 2 {
+		t.Fatalf("bob should see both players in den, got %v", entered.Participants)
+	}
+	waitForEvent(t, alice, EventEnterRoom)
+
+	/* A cooperative game: alice guesses, bob gives clues. */
+	route(managerB, bob, EventChangeRole, nil)
+	waitForEvent(t, alice, EventUpdateParticipant)
+	route(managerA, alice, EventNewGame, NewGameRequestEvent{})
+	var game NewGameResponseEvent
+	json.Unmarshal(waitForEvent(t, bob, EventNewGame).Payload, &game)
+	colors := 0
+	for _, color := range game.Cards {
+		if color != "white" {
+			colors++
+		}
+	}
+	if colors == 0 {
+		t.Error("bob is a cluegiver and should see the key card")
+	}
+	waitForEvent(t, alice, EventNewGame)
+
+	if managerB.game("den") != nil {
+		t.Error("the game should only exist on the instance that owns the room")
+	}
+	managerA.room("den").do(func() error {
+		if players := len(managerA.game("den").players); players != 2 {
+			t.Errorf("expected 2 players, got %v", players)
+		}
+		return nil
+	})
+
+	route(managerB, bob, EventGiveClue, map[string]string{"clue": "shared", "numCards": "1"})
+	var clue GiveClueEvent
+	json.Unmarshal(waitForEvent(t, alice, EventGiveClue).Payload, &clue)
+	if clue.Clue != "shared" {
+		t.Errorf("alice got the wrong clue: %v", clue.Clue)
+	}
+
+	/* Bob leaves for a room on his own instance, keeping his role. */
+	route(managerB, bob, EventEnterRoom, ChangeRoomEvent{UserName: "bob", RoomName: "lobby"})
+	waitForEvent(t, alice, EventExitRoom)
+	waitForEvent(t, bob, EventEnterRoom)
+	if bob.role != cluegiver {
+		t.Errorf("bob's role was not kept: %v", bob.role)
+	}
+	if managerB.ownerOf("lobby") != "B" {
+		t.Error("bob's instance should have claimed the lobby")
+	}
+
+	/* And back, then disconnects. */
+	route(managerB, bob, EventEnterRoom, ChangeRoomEvent{UserName: "bob", RoomName: "den"})
+	waitForEvent(t, alice, EventEnterRoom)
+	managerB.removeClient(bob)
+	waitForEvent(t, alice, EventExitRoom)
+	managerA.room("den").do(func() error {
+		if _, exists := managerA.room("den").clients["bob"]; exists {
+			t.Error("bob still in den after disconnecting")
+		}
+		return nil
+	})
+
+	/* User names are unique across instances. */
+	if owner, _ := broker.Claim(userClaim("carol"), "A", ownershipTTL); owner != "A" {
+		t.Fatalf("could not claim user name: %v", owner)
+	}
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"username": "carol"}`)
+	managerB.loginHandler(w, httptest.NewRequest(http.MethodPost, "/login", body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for a name in use on another instance, got %v", w.Code)
+	}
+}
+
+/* Counts the claims made on rooms. */
+type roomClaimCounter struct {
+	Broker
+	claims atomic.Int64
+}
+
+func (b *roomClaimCounter) Claim(key string, owner string, ttl time.Duration) (string, error) {
+	if strings.HasPrefix(key, "room.") {
+		b.claims.Add(1)
+	}
+	return b.Broker.Claim(key, owner, ttl)
+}
+
+/* Owners are remembered, and forgotten when a room is given up. */
+func TestRoomOwners(t *testing.T) {
+	broker := &roomClaimCounter{Broker: NewLocalBroker()}
+	managerA, err := NewManagerWithBroker(context.Background(), broker, "A", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managerB, err := NewManagerWithBroker(context.Background(), broker, "B", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if owner := managerA.ownerOf("den"); owner != "A" {
+			t.Fatalf("A: owner %v", owner)
+		}
+		if owner := managerB.ownerOf("den"); owner != "A" {
+			t.Fatalf("B: owner %v", owner)
+		}
+	}
+	if n := broker.claims.Load(); n != 2 {
+		t.Errorf("claimed %v times", n)
+	}
+
+	managerA.releaseRoom("den")
+	deadline := time.Now().Add(2 * time.Second)
+	for managerB.ownerOf("den") != "B" {
+		if time.Now().After(deadline) {
+			t.Fatal("B still has A as the owner of a released room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if owner := managerA.ownerOf("den"); owner != "B" {
+		t.Errorf("A: owner %v after releasing", owner)
+	}
+}
+
+/* Connecting to another instance ends the session at the first. */
+func TestSessionReplaced(t *testing.T) {
+	websocketUpgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	broker := NewLocalBroker()
+	managerA, err := NewManagerWithBroker(context.Background(), broker, "A", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managerB, err := NewManagerWithBroker(context.Background(), broker, "B", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := NewClient("alice", nil, managerA)
+	managerA.addClient(alice)
+	broker.Claim(userClaim("alice"), "A", ownershipTTL)
+
+	s := httptest.NewServer(http.HandlerFunc(managerB.serveWS))
+	defer s.Close()
+	otp, _ := managerB.otps.NewOTP("alice")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"?otp="+otp.Key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var notice ServerNoticeEvent
+	json.Unmarshal(waitForEvent(t, alice, EventServerNotice).Payload, &notice)
+	if notice.Message != replacedMessage {
+		t.Errorf("notice: %+v", notice)
+	}
+	managerA.RLock()
+	_, exists := managerA.clients["alice"]
+	managerA.RUnlock()
+	if exists {
+		t.Error("alice still connected to A")
+	}
+	if owner, _ := broker.Claim(userClaim("alice"), "C", ownershipTTL); owner != "B" {
+		t.Errorf("user name owned by %v", owner)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/* Server settings. Each setting can be given, in increasing order of
+   precedence, in a JSON config file, in an environment variable or as
+   a command-line flag. The environment variable for flag -otp-lifetime
+   is GARBANZO_OTP_LIFETIME, and so on. */
+type Config struct {
+	/* Config file to read, from -config or GARBANZO_CONFIG. */
+	ConfigFile string `json:"-"`
+
+	Addr        string `json:"addr"`
+	/* False serves plain HTTP, e.g. behind a TLS-terminating proxy. */
+	TLS         bool   `json:"tls"`
+	CertFile    string `json:"certFile"`
+	KeyFile     string `json:"keyFile"`
+	/* The OpenAI key, for the "openai" provider. */
+	GPTKeyFile  string `json:"gptKeyFile"`
+	/* Empty is OpenAI's API; else any OpenAI-compatible server, for
+	   the "openai" provider. */
+	LLMBaseURL  string `json:"llmBaseUrl"`
+	/* Empty: external/wordlist.txt if it exists, else wordlist.txt. */
+	WordList    string `json:"wordList"`
+	GameStore   string `json:"gameStore"`
+	FrontendDir string `json:"frontendDir"`
+	/* "local" for a single instance, or the redis:// URL of
+	   the server shared by several instances. */
+	Broker      string `json:"broker"`
+	/* Empty picks a random ID at startup. */
+	InstanceID  string `json:"instanceId"`
+
+	/* "memory", or "shared" to keep logins in the broker so a user
+	   may connect to another instance than the one they logged in on,
+	   or "token" for signed tokens any instance can check.
+	   Empty picks "shared" with a redis broker, "memory" otherwise. */
+	OTPStore     string   `json:"otpStore"`
+	/* Signing key for "token"; TokenKeyFile is read if it is empty. */
+	TokenKey     string   `json:"tokenKey"`
+	TokenKeyFile string   `json:"tokenKeyFile"`
+	OTPLifetime  Duration `json:"otpLifetime"`
+	PongWait     Duration `json:"pongWait"`
+	PingInterval Duration `json:"pingInterval"`
+	ReadLimit    int64    `json:"readLimit"`
+	EgressBuffer int      `json:"egressBuffer"`
+	EgressPolicy string   `json:"egressPolicy"`
+
+	/* Abuse protection. EventLimits are by event type, e.g.
+	   {"send_message": "5:10"}, and EventLimit is for other types. */
+	LoginLimit  RateLimit   `json:"loginLimit"`
+	RoomLimit   RateLimit   `json:"roomLimit"`
+	EventLimit  RateLimit   `json:"eventLimit"`
+	EventLimits EventLimits `json:"eventLimits"`
+	BanStrikes  int         `json:"banStrikes"`
+	BanWindow   Duration    `json:"banWindow"`
+	BanDuration Duration    `json:"banDuration"`
+	/* Behind a reverse proxy: take client addresses from X-Forwarded-For. */
+	TrustProxy  bool        `json:"trustProxy"`
+
+	/* Bearer token for the admin API; AdminTokenFile is read if it
+	   is empty. Neither disables the admin API. */
+	AdminToken     string `json:"adminToken"`
+	AdminTokenFile string `json:"adminTokenFile"`
+
+	/* debug, info, warn or error; bot prompts and responses are
+	   logged at debug. Verbose is the same as LogLevel "debug". */
+	LogLevel           string   `json:"logLevel"`
+	LogFormat          string   `json:"logFormat"`
+	Verbose            bool     `json:"verbose"`
+
+	/* none, otlp, stdout or file. TraceEndpoint is the collector's
+	   URL for otlp; empty uses OTEL_EXPORTER_OTLP_ENDPOINT. */
+	TraceExporter      string   `json:"traceExporter"`
+	TraceEndpoint      string   `json:"traceEndpoint"`
+	TraceFile          string   `json:"traceFile"`
+
+	/* More LLM providers by name, only in the config file, e.g.
+	   {"ollama": {"baseUrl": "http://localhost:11434/v1"}}. */
+	Providers          map[string]ProviderConfig `json:"providers"`
+	BotProvider        string   `json:"botProvider"`
+	BotModel           string   `json:"botModel"`
+	/* Models and personas players may pick for bot seats, only in
+	   the config file. */
+	BotCatalog         BotCatalog `json:"botCatalog"`
+	/* Tokens the bots may use a day on this instance, in all rooms and
+	   in each room; 0 is no limit. The admin API can change them. */
+	LLMDailyBudget     int      `json:"llmDailyBudget"`
+	LLMRoomBudget      int      `json:"llmRoomBudget"`
+	BotShutdownWait    Duration `json:"botShutdownWait"`
+	SnapshotOnShutdown bool     `json:"snapshotOnShutdown"`
+}
+
+/* A time.Duration written as a string such as "10s" in config files. */
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+const envPrefix = "GARBANZO_"
+
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:               ":8080",
+		TLS:                true,
+		CertFile:           "external/server.crt",
+		KeyFile:            "external/server.key",
+		GPTKeyFile:         "external/gpt-secretkey.txt",
+		GameStore:          "external/games.db",
+		FrontendDir:        "./frontend",
+		Broker:             "local",
+		TokenKeyFile:       "external/token-key.txt",
+		OTPLifetime:        Duration(otpLifetime),
+		PongWait:           Duration(pongWait),
+		PingInterval:       Duration(pingInterval),
+		ReadLimit:          readLimit,
+		EgressBuffer:       egressBuffer,
+		EgressPolicy:       string(egressPolicy),
+		LoginLimit:         loginLimit,
+		RoomLimit:          roomLimit,
+		EventLimit:         defaultEventLimit,
+		EventLimits:        maps.Clone(eventLimits),
+		BanStrikes:         banStrikes,
+		BanWindow:          Duration(banWindow),
+		BanDuration:        Duration(banDuration),
+		TrustProxy:         trustProxy,
+		AdminTokenFile:     "external/admin-token.txt",
+		LogLevel:           "info",
+		LogFormat:          LogFormatJSON,
+		TraceExporter:      TraceExporterNone,
+		TraceFile:          "traces.json",
+		BotProvider:        botProvider,
+		BotModel:           botModel,
+		BotShutdownWait:    Duration(botShutdownWait),
+		SnapshotOnShutdown: snapshotOnShutdown,
+	}
+}
+
+func (cfg *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("expert-garbanzo", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigFile, "config", cfg.ConfigFile, "JSON config file")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to listen on")
+	fs.BoolVar(&cfg.TLS, "tls", cfg.TLS, "serve HTTPS; use -tls=false behind a TLS-terminating proxy")
+	fs.StringVar(&cfg.CertFile, "cert-file", cfg.CertFile, "server certificate")
+	fs.StringVar(&cfg.KeyFile, "key-file", cfg.KeyFile, "server key")
+	fs.StringVar(&cfg.GPTKeyFile, "gpt-key-file", cfg.GPTKeyFile, "file with the OpenAI API key")
+	fs.StringVar(&cfg.LLMBaseURL, "llm-base-url", cfg.LLMBaseURL, "OpenAI-compatible API for the openai provider, e.g. http://localhost:11434/v1 for Ollama (default OpenAI's)")
+	fs.StringVar(&cfg.WordList, "word-list", cfg.WordList, "word list, one word per line")
+	fs.StringVar(&cfg.GameStore, "game-store", cfg.GameStore, "database of finished games")
+	fs.StringVar(&cfg.FrontendDir, "frontend-dir", cfg.FrontendDir, "directory of static files")
+	fs.StringVar(&cfg.Broker, "broker", cfg.Broker, "\"local\", or a redis:// URL to share rooms between instances")
+	fs.StringVar(&cfg.InstanceID, "instance-id", cfg.InstanceID, "name of this instance (default random)")
+	fs.StringVar(&cfg.OTPStore, "otp-store", cfg.OTPStore, "where logins are kept: \"memory\", \"shared\" through the broker, or \"token\" for signed tokens (default shared with a redis broker)")
+	fs.StringVar(&cfg.TokenKey, "token-key", cfg.TokenKey, "key signing login tokens; prefer GARBANZO_TOKEN_KEY to the flag")
+	fs.StringVar(&cfg.TokenKeyFile, "token-key-file", cfg.TokenKeyFile, "file with the key signing login tokens, if -token-key is not set")
+	fs.DurationVar((*time.Duration)(&cfg.OTPLifetime), "otp-lifetime", time.Duration(cfg.OTPLifetime), "how long a login is valid before connecting")
+	fs.DurationVar((*time.Duration)(&cfg.PongWait), "pong-wait", time.Duration(cfg.PongWait), "how long to wait for a pong before dropping a client")
+	fs.DurationVar((*time.Duration)(&cfg.PingInterval), "ping-interval", time.Duration(cfg.PingInterval), "how often to ping clients")
+	fs.Int64Var(&cfg.ReadLimit, "read-limit", cfg.ReadLimit, "largest message accepted from a client, in bytes")
+	fs.IntVar(&cfg.EgressBuffer, "egress-buffer", cfg.EgressBuffer, "messages queued per client")
+	fs.StringVar(&cfg.EgressPolicy, "egress-policy", cfg.EgressPolicy, "when a client's queue is full: drop, drop_oldest or disconnect")
+	fs.Var(&cfg.LoginLimit, "login-limit", "logins per second per client address, and burst, as <rate>:<burst>")
+	fs.Var(&cfg.RoomLimit, "room-limit", "new chat rooms per second per client, and burst, as <rate>:<burst>")
+	fs.Var(&cfg.EventLimit, "event-limit", "events per second per client, and burst, for event types without their own limit")
+	fs.Var(&cfg.EventLimits, "event-limits", "limits by event type, e.g. send_message=5:10,new_game=0.2:2")
+	fs.IntVar(&cfg.BanStrikes, "ban-strikes", cfg.BanStrikes, "throttled events within -ban-window that get a client banned")
+	fs.DurationVar((*time.Duration)(&cfg.BanWindow), "ban-window", time.Duration(cfg.BanWindow), "window for counting throttled events")
+	fs.DurationVar((*time.Duration)(&cfg.BanDuration), "ban-duration", time.Duration(cfg.BanDuration), "how long a banned client's address is refused")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", cfg.TrustProxy, "take client addresses from X-Forwarded-For, set by a reverse proxy")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "token for the admin API; prefer GARBANZO_ADMIN_TOKEN to the flag")
+	fs.StringVar(&cfg.AdminTokenFile, "admin-token-file", cfg.AdminTokenFile, "file with the admin API token, if -admin-token is not set; the API is disabled if neither is")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "least severe log level shown: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "json, or console for people")
+	fs.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "log bot prompts and responses; same as -log-level debug")
+	fs.StringVar(&cfg.TraceExporter, "trace-exporter", cfg.TraceExporter, "where spans go: none, otlp to a collector, stdout or file")
+	fs.StringVar(&cfg.TraceEndpoint, "trace-endpoint", cfg.TraceEndpoint, "collector URL for -trace-exporter otlp, e.g. http://localhost:4318")
+	fs.StringVar(&cfg.TraceFile, "trace-file", cfg.TraceFile, "file spans are appended to for -trace-exporter file")
+	fs.StringVar(&cfg.BotProvider, "bot-provider", cfg.BotProvider, "LLM provider for bot players: openai, or one named in the config file")
+	fs.StringVar(&cfg.BotModel, "bot-model", cfg.BotModel, "model for bot players")
+	fs.IntVar(&cfg.LLMDailyBudget, "llm-daily-budget", cfg.LLMDailyBudget, "tokens bots may use a day, in all rooms; 0 is no limit")
+	fs.IntVar(&cfg.LLMRoomBudget, "llm-room-budget", cfg.LLMRoomBudget, "tokens bots may use a day in each room; 0 is no limit")
+	fs.DurationVar((*time.Duration)(&cfg.BotShutdownWait), "bot-shutdown-wait", time.Duration(cfg.BotShutdownWait), "how long shutdown waits for bot calls")
+	fs.BoolVar(&cfg.SnapshotOnShutdown, "snapshot-on-shutdown", cfg.SnapshotOnShutdown, "save games in progress at shutdown")
+	return fs
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+/* Build the configuration from defaults, the config file, the
+   environment and args, in that order, and validate it. */
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	/* A first pass finds the config file and rejects bad flags early. */
+	scratch := DefaultConfig()
+	if path, ok := lookupEnv(envName("config")); ok {
+		scratch.ConfigFile = path
+	}
+	if err := scratch.flagSet().Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	if scratch.ConfigFile != "" {
+		if err := cfg.readFile(scratch.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := cfg.flagSet()
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := lookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", envName(f.Name), err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("bad config file %v: %v", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, a ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, a...))
+		}
+	}
+	fileExists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	check(cfg.Addr != "", "addr must not be empty")
+	if cfg.TLS {
+		check(fileExists(cfg.CertFile), "cert-file %v not found (use -tls=false for plain HTTP)", cfg.CertFile)
+		check(fileExists(cfg.KeyFile), "key-file %v not found (use -tls=false for plain HTTP)", cfg.KeyFile)
+	}
+	if cfg.WordList != "" {
+		check(fileExists(cfg.WordList), "word-list %v not found", cfg.WordList)
+	}
+	check(cfg.GameStore != "", "game-store must not be empty")
+	check(cfg.Broker == "local" || strings.HasPrefix(cfg.Broker, "redis://") || strings.HasPrefix(cfg.Broker, "rediss://"),
+		"broker must be \"local\" or a redis:// URL")
+	check(cfg.OTPStore == "" || cfg.OTPStore == "memory" || cfg.OTPStore == "shared" || cfg.OTPStore == "token",
+		"otp-store must be \"memory\", \"shared\" or \"token\"")
+	if cfg.OTPStore == "token" {
+		key, err := readTokenKey(cfg.TokenKey, cfg.TokenKeyFile)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			check(len(key) >= minTokenKeyLength, "token key must be at least %v bytes", minTokenKeyLength)
+		}
+	}
+	check(cfg.OTPLifetime > 0, "otp-lifetime must be positive")
+	check(cfg.PongWait > 0, "pong-wait must be positive")
+	check(cfg.PingInterval > 0 && cfg.PingInterval < cfg.PongWait,
+		"ping-interval must be positive and shorter than pong-wait")
+	check(cfg.ReadLimit > 0, "read-limit must be positive")
+	check(cfg.EgressBuffer > 0, "egress-buffer must be positive")
+	if _, err := NewEgressPolicy(cfg.EgressPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	check(cfg.BanStrikes > 0, "ban-strikes must be positive")
+	check(cfg.BanWindow > 0, "ban-window must be positive")
+	check(cfg.BanDuration >= 0, "ban-duration must not be negative")
+	if token, err := readAdminToken(cfg.AdminToken, cfg.AdminTokenFile); err != nil {
+		errs = append(errs, fmt.Errorf("could not read admin token: %v", err))
+	} else {
+		check(token == "" || len(token) >= minAdminTokenLength,
+			"admin token must be at least %v bytes", minAdminTokenLength)
+	}
+	switch level, err := zerolog.ParseLevel(cfg.LogLevel); {
+	case err != nil, level < zerolog.DebugLevel, level > zerolog.ErrorLevel:
+		errs = append(errs, fmt.Errorf("log-level must be debug, info, warn or error"))
+	}
+	check(cfg.LogFormat == LogFormatJSON || cfg.LogFormat == LogFormatConsole,
+		"log-format must be \"json\" or \"console\"")
+	switch cfg.TraceExporter {
+	case TraceExporterNone, TraceExporterOTLP, TraceExporterStdout:
+	case TraceExporterFile:
+		check(cfg.TraceFile != "", "trace-file must not be empty")
+	default:
+		errs = append(errs, fmt.Errorf("trace-exporter must be none, otlp, stdout or file"))
+	}
+	if err := (ProviderConfig{BaseURL: cfg.LLMBaseURL}).validate(defaultProvider); err != nil {
+		errs = append(errs, err)
+	}
+	for name, pc := range cfg.Providers {
+		if err := pc.validate(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	_, named := cfg.Providers[cfg.BotProvider]
+	check(cfg.BotProvider == defaultProvider || named,
+		"bot-provider %v is not in the config file's providers", cfg.BotProvider)
+	check(cfg.BotModel != "", "bot-model must not be empty")
+	errs = append(errs, cfg.BotCatalog.validate(cfg.Providers)...)
+	check(cfg.LLMDailyBudget >= 0, "llm-daily-budget must not be negative")
+	check(cfg.LLMRoomBudget >= 0, "llm-room-budget must not be negative")
+	check(cfg.BotShutdownWait >= 0, "bot-shutdown-wait must not be negative")
+
+	return errors.Join(errs...)
+}
+
+/* Set the package-level settings. Call once, before starting the server. */
+func (cfg *Config) apply() {
+	logLevel := cfg.LogLevel
+	if cfg.Verbose {
+		logLevel = zerolog.LevelDebugValue
+	}
+	setupLogging(logLevel, cfg.LogFormat, os.Stderr)
+	otpLifetime = time.Duration(cfg.OTPLifetime)
+	pongWait = time.Duration(cfg.PongWait)
+	pingInterval = time.Duration(cfg.PingInterval)
+	readLimit = cfg.ReadLimit
+	egressBuffer = cfg.EgressBuffer
+	egressPolicy, _ = NewEgressPolicy(cfg.EgressPolicy)
+	loginLimit = cfg.LoginLimit
+	roomLimit = cfg.RoomLimit
+	defaultEventLimit = cfg.EventLimit
+	eventLimits = cfg.EventLimits
+	banStrikes = cfg.BanStrikes
+	banWindow = time.Duration(cfg.BanWindow)
+	banDuration = time.Duration(cfg.BanDuration)
+	trustProxy = cfg.TrustProxy
+	botProvider = cfg.BotProvider
+	botModel = cfg.BotModel
+	botCatalog = cfg.BotCatalog
+	botShutdownWait = time.Duration(cfg.BotShutdownWait)
+	snapshotOnShutdown = cfg.SnapshotOnShutdown
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	file := `{"addr": ":9000", "tls": false, "pongWait": "20s", "pingInterval": "8s", "botModel": "file-model", "eventLimits": {"send_message": "2:4"}}`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"GARBANZO_CONFIG":        path,
+		"GARBANZO_PING_INTERVAL": "9s",
+		"GARBANZO_BOT_MODEL":     "env-model",
+		"GARBANZO_EVENT_LIMITS":  "give_clue=3:3",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg, err := LoadConfig([]string{"-bot-model", "flag-model", "-login-limit", "1:2"}, lookupEnv)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	/* Flags beat the environment, which beats the file, which beats the defaults. */
+	if cfg.Addr != ":9000" || cfg.TLS {
+		t.Errorf("file settings not applied: %v, tls %v", cfg.Addr, cfg.TLS)
+	}
+	if time.Duration(cfg.PongWait) != 20*time.Second {
+		t.Errorf("expected pong wait from file, got %v", time.Duration(cfg.PongWait))
+	}
+	if time.Duration(cfg.PingInterval) != 9*time.Second {
+		t.Errorf("expected ping interval from environment, got %v", time.Duration(cfg.PingInterval))
+	}
+	if cfg.BotModel != "flag-model" {
+		t.Errorf("expected bot model from flag, got %v", cfg.BotModel)
+	}
+	/* Event limits add to the defaults. */
+	if cfg.EventLimits[EventSendMessage] != (RateLimit{2, 4}) || cfg.EventLimits[EventGiveClue] != (RateLimit{3, 3}) ||
+		cfg.EventLimits[EventNewGame] != eventLimits[EventNewGame] {
+		t.Errorf("event limits: %v", cfg.EventLimits)
+	}
+	if cfg.LoginLimit != (RateLimit{1, 2}) {
+		t.Errorf("expected login limit from flag, got %v", cfg.LoginLimit)
+	}
+	if cfg.ReadLimit != DefaultConfig().ReadLimit {
+		t.Errorf("expected default read limit, got %v", cfg.ReadLimit)
+	}
+
+	/* Every problem is reported at once. */
+	_, err = LoadConfig([]string{"-tls=false", "-ping-interval", "1m", "-egress-policy", "coalesce", "-otp-store", "disk",
+		"-log-level", "trace", "-log-format", "xml", "-bot-provider", "ollama", "-llm-base-url", "localhost:11434"}, lookupEnv)
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, want := range []string{"ping-interval", "egress policy", "otp-store", "log-level", "log-format", "bot-provider", "base URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %v", err, want)
+		}
+	}
+
+	env["GARBANZO_PONG_WAIT"] = "soon"
+	if _, err := LoadConfig(nil, lookupEnv); err == nil {
+		t.Error("bad duration in environment accepted")
+	}
+	delete(env, "GARBANZO_PONG_WAIT")
+
+	if err := os.WriteFile(path, []byte(`{"port": 9000}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(nil, lookupEnv); err == nil {
+		t.Error("unknown setting in config file accepted")
+	}
+}
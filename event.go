@@ -6,8 +6,16 @@ import (
 )
 
 type Event struct {
-	Type    string          `json:"type"`
-	Payload json.RawMessage `json:"payload"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	/* From a client: send an ack once the event is handled. */
+	Ack       bool            `json:"ack,omitempty"`
+	/* Chosen by the client for a request, and copied to the events
+	   the server sends in handling it, including broadcasts. */
+	RequestID string          `json:"requestId,omitempty"`
+	/* To a client: 1, 2, 3... for each event sent on the connection,
+	   including any the client missed because it fell behind. */
+	Seq       uint64          `json:"seq,omitempty"`
 }
 
 type EventHandler func(event Event, c *Client) error
@@ -29,6 +37,14 @@ const (
 	EventBotWait     = "bot_wait"
 	EventGameOver    = "game_over"
 	EventInvalidState = "invalid_state"
+	EventRematch     = "rematch"
+	EventGetStats    = "get_stats"
+	EventStats       = "stats"
+	EventServerShutdown = "server_shutdown"
+	EventServerNotice   = "server_notice"
+	EventThrottled      = "throttled"
+	EventError          = "error"
+	EventAck            = "ack"
 )
 
 type SendMessageEvent struct {
@@ -50,12 +66,30 @@ type ChangeRoomEvent struct {
 }
 
 type NewGameRequestEvent struct {
-	Bots BotActions `json:"bots"`
+	Bots   BotActions `json:"bots"`
+	BestOf int        `json:"bestOf"`
+}
+
+type RematchRequestEvent struct {
+	RotateTeams bool `json:"rotateTeams"`
+	RotateRoles bool `json:"rotateRoles"`
+}
+
+type SeriesEvent struct {
+	BestOf int   `json:"bestOf"`
+	Game   int   `json:"game"`
+	Wins   Score `json:"wins"`
+	Over   bool  `json:"over"`
+	Winner Team  `json:"winner,omitempty"`
 }
 
 type NewGameResponseEvent struct {
-	Cards      Deck  `json:"cards"`
-	TeamTurn   Team  `json:"teamTurn"`
+	GameID     string       `json:"gameId"`
+	Cards      Deck         `json:"cards"`
+	TeamTurn   Team         `json:"teamTurn"`
+	Series     *SeriesEvent `json:"series,omitempty"`
+	/* The bot seats and how each is played. */
+	Bots       []Participant `json:"bots,omitempty"`
 }
 
 type PlayerAlignmentResponse struct {
@@ -92,6 +126,53 @@ type GuessResponseEvent struct {
 }
 
 type GameOverEvent struct {
-	Message  string  `json:"message"`
-	Cards    Deck    `json:"cards"`
-}
\ No newline at end of file
+	GameID   string       `json:"gameId"`
+	Message  string       `json:"message"`
+	Cards    Deck         `json:"cards"`
+	KeyCard  Deck         `json:"keyCard"`
+	Log      GameLog      `json:"log"`
+	Series   *SeriesEvent `json:"series,omitempty"`
+	/* What the bots used, in games with bots. */
+	Usage    *Usage       `json:"usage,omitempty"`
+}
+
+type StatsRequestEvent struct {
+	UserName string `json:"name"`
+}
+
+type StatsResponseEvent struct {
+	Leaderboard []*PlayerStats `json:"leaderboard"`
+	Player      *PlayerStats   `json:"player,omitempty"`
+}
+
+type ServerShutdownEvent struct {
+	Message string `json:"message"`
+}
+
+/* A message from the server's admins. */
+type ServerNoticeEvent struct {
+	Message string `json:"message"`
+}
+
+/* An event was dropped for exceeding its rate limit. RetryAfter is
+   in milliseconds. */
+type ThrottledEvent struct {
+	Event      string `json:"event,omitempty"`
+	RetryAfter int64  `json:"retryAfter"`
+	Message    string `json:"message"`
+	/* The client is being disconnected for flooding. */
+	Banned     bool   `json:"banned,omitempty"`
+}
+
+/* A request from the client failed. Request is its event type, and
+   Code one of the ErrCode constants. */
+type ErrorEvent struct {
+	Request string `json:"request"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+/* A request from the client that asked for an ack was handled. */
+type AckEvent struct {
+	Request string `json:"request"`
+}
@@ -1,9 +1,10 @@
 "use strict";
 
 class Event {
-    constructor(type, payload){
+    constructor(type, payload, requestId){
         this.type = type;
         this.payload = payload;
+        this.requestId = requestId;
     }
 }
 
@@ -34,15 +35,25 @@ class ChangeChatRoomEvent {
 }
 
 class NewGameRequestEvent {
-    constructor(bots) {
+    constructor(bots, bestOf) {
         this.bots = bots;
+        this.bestOf = bestOf;
     }
 }
 
 class NewGameResponseEvent {
-    constructor(cards, teamTurn) {
+    constructor(cards, teamTurn, series, bots) {
         this.cards = cards;
         this.teamTurn = teamTurn;
+        this.series = series;
+        this.bots = bots;
+    }
+}
+
+class RematchRequestEvent {
+    constructor(rotateTeams, rotateRoles) {
+        this.rotateTeams = rotateTeams;
+        this.rotateRoles = rotateRoles;
     }
 }
 
@@ -93,9 +104,14 @@ class EndTurnEvent {
 }
 
 class GameOverEvent {
-    constructor(message, cards) {
+    constructor(gameId, message, cards, keyCard, log, series, usage) {
+        this.gameId = gameId
         this.message = message
         this.cards = cards
+        this.keyCard = keyCard
+        this.log = log
+        this.series = series
+        this.usage = usage
     }
 }
 
@@ -117,6 +133,8 @@ let userRole = guesserRole;
 let selectedChat = "";
 let currentGame = null;
 let gameInProgress = false;
+let lastRequestId = 0;  // numbers our requests
+let lastSeq = 0;        // last event number received from the server
 let teamTurn;
 let roleTurn;
 
@@ -143,6 +161,83 @@ function disableBotCheckboxes(boolean) {
             boxes[i].checked = false;
         }
     }
+    for (const setting of document.getElementById("bot-settings").querySelectorAll("select, input")) {
+        setting.disabled = boolean;
+    }
+}
+
+/* The bot seats, by the checkbox that adds each one. */
+const botSeats = [
+    {box: "AIRedClue",   team: "red",  role: "cluegiver", label: "Red Clue Giver"},
+    {box: "AIRedGuess",  team: "red",  role: "guesser",   label: "Red Guesser"},
+    {box: "AIBlueClue",  team: "blue", role: "cluegiver", label: "Blue Clue Giver"},
+    {box: "AIBlueGuess", team: "blue", role: "guesser",   label: "Blue Guesser"},
+];
+
+/* Offer the server's models and personas for each bot seat. */
+function setupBotSettings(catalog) {
+    const settings = document.getElementById("bot-settings");
+    const select = (id, options) => {
+        const element = document.createElement("select");
+        element.className = "txt";
+        element.id = id;
+        element.setAttribute("data-testid", id);
+        for (const {name, description} of options) {
+            const option = document.createElement("option");
+            option.value = name;
+            option.innerText = name;
+            option.title = description || "";
+            element.appendChild(option);
+        }
+        return element;
+    };
+    for (const seat of botSeats) {
+        const label = document.createElement("span");
+        label.innerText = seat.label;
+        const temperature = document.createElement("input");
+        temperature.className = "txt";
+        temperature.type = "number";
+        temperature.id = `${seat.box}-temperature`;
+        temperature.setAttribute("data-testid", temperature.id);
+        temperature.min = 0;
+        temperature.max = catalog.maxTemperature;
+        temperature.step = 0.1;
+        temperature.placeholder = "default";
+        settings.append(
+            label,
+            select(`${seat.box}-model`, catalog.models),
+            select(`${seat.box}-persona`, catalog.personas),
+            temperature,
+        );
+    }
+    settings.hidden = false;
+}
+
+/* The settings of the bot seats being added. */
+function botSeatSettings() {
+    const seats = [];
+    for (const seat of botSeats) {
+        if (!document.getElementById(seat.box).checked) {
+            continue;
+        }
+        const model = document.getElementById(`${seat.box}-model`);
+        if (model === null) {
+            /* The server did not say what it offers. */
+            continue;
+        }
+        const settings = {
+            team: seat.team,
+            role: seat.role,
+            model: model.value,
+            persona: document.getElementById(`${seat.box}-persona`).value,
+        };
+        const temperature = document.getElementById(`${seat.box}-temperature`).value;
+        if (temperature !== "") {
+            settings.temperature = parseFloat(temperature);
+        }
+        seats.push(settings);
+    }
+    return seats;
 }
 
 function abortGame() {
@@ -177,6 +272,7 @@ function resetGame() {
     document.getElementById("newgame-button").hidden = false;
     document.getElementById("game-setup").hidden = false;
     document.getElementById("gameboard-container").hidden = true;
+    document.getElementById("rematch").hidden = true;
 }
 
 function newGameHandler(payload) {
@@ -208,9 +304,18 @@ function newGameHandler(payload) {
     document.getElementById("game-setup").hidden = true;
     document.getElementById("newgame-button").hidden = true;
     document.getElementById("abort-button").hidden = false;
+    document.getElementById("rematch").hidden = true;
 
     disableBotCheckboxes(true);
 
+    /* The bots are in the game until it ends. */
+    removeBotParticipants();
+    addParticipantsList(currentGame.bots || []);
+
+    if (currentGame.series) {
+        appendToChat(`** ${seriesSummary(currentGame.series)} **`);
+    }
+
     teamTurn = currentGame.teamTurn;
     roleTurn = cluegiverRole;
     whoseTurn(teamTurn, roleTurn);
@@ -304,11 +409,30 @@ function requestNewGame() {
             "red":  document.getElementById("AIRedGuess").checked,
             "blue": document.getElementById("AIBlueGuess").checked,
         },
+        "seats": botSeatSettings(),
     });
+    game.bestOf = parseInt(document.getElementById("best-of").value);
     sendEvent("new_game", game);
     return false;
 }
 
+function requestRematch() {
+    const rematch = new RematchRequestEvent(
+        document.getElementById("rotate-teams").checked,
+        document.getElementById("rotate-roles").checked,
+    );
+    sendEvent("rematch", rematch);
+    return false;
+}
+
+function seriesSummary({bestOf, game, wins, over, winner}) {
+    const score = `Red ${wins.red} - Blue ${wins.blue}`;
+    if (over) {
+        return `${capitalize(winner)} Team wins the best-of-${bestOf} series, ${score}`;
+    }
+    return `Game ${game} of best of ${bestOf}: ${score}`;
+}
+
 function changeRole() {
     userRole = document.getElementById("role").value;
     sendEvent("change_role", null);
@@ -342,6 +466,9 @@ function appendParticipantDiv(participant) {
     child.className = "participant";
     child.id = `participant-${name}`;
     child.setAttribute("data-testid", `participant-${name}`);
+    if (participant.bot) {
+        child.setAttribute("data-bot", "true");
+    }
     container.appendChild(child);
     updateParticipant(participant);
 }
@@ -370,13 +497,24 @@ function addParticipantsList(participantsList) {
     }
 }
 
-function updateParticipant({name, teamColor, role, inGame}) {
+function updateParticipant({name, teamColor, role, inGame, bot}) {
+    if (name === userName) {
+        /* Teams and roles may be rotated by the server in a rematch. */
+        userTeam = teamColor;
+        userRole = role;
+        document.getElementById("team").value = teamColor;
+        document.getElementById("role").value = role;
+    }
     const participant = document.getElementById(`participant-${name}`);
     if (selectedChat === defaultRoom) {
         participant.innerHTML = name;
         return;
     }
-    if (!gameInProgress || inGame) {
+    if (bot) {
+        const temperature = bot.temperature === undefined ? "" : `, temperature ${bot.temperature}`;
+        participant.innerHTML = `${name} <span style="color:${teamColor}">${teamColor} ${role}</span>` +
+            ` (${bot.model}, ${bot.persona}${temperature})`;
+    } else if (!gameInProgress || inGame) {
         participant.innerHTML = `${name} <span style="color:${teamColor}">${teamColor} ${role}</span>`;
     } else {
         participant.innerHTML = name;
@@ -411,6 +549,13 @@ function removeParticipant(name) {
     }
 }
 
+function removeBotParticipants() {
+    const container = document.getElementById("participants");
+    for (const child of container.querySelectorAll("[data-bot]")) {
+        container.removeChild(child);
+    }
+}
+
 function removeAllParticipants() {
     const container = document.getElementById("participants");
     container.innerHTML = "";
@@ -458,6 +603,7 @@ function notifyRoomEntry(payload) {
             document.getElementById("game-setup").hidden = true;
             welcome.innerText = `Welcome to the lobby, ${userName}. Go to any chat room to play a game.`;
             message += `the lobby.`;
+            sendEvent("get_stats", {name: userName});
         } else {
             document.getElementById("game-setup").hidden = false;
             welcome.innerText = `Welcome to ${selectedChat}, ${userName}.`;
@@ -704,6 +850,26 @@ function routeEvent(event) {
         case "invalid_state":
             invalidStateHandler(event.payload);
             break;
+        case "stats":
+            showLeaderboard(event.payload);
+            break;
+        case "server_shutdown":
+            appendToChat(`** ${htmlEscape(event.payload.message)} **`);
+            break;
+        case "server_notice":
+            appendToChat(`** ${htmlEscape(event.payload.message)} **`);
+            break;
+        case "throttled":
+            appendToChat(`** ${htmlEscape(event.payload.message)} **`);
+            break;
+        case "error":
+            /* The room has already been told why its game didn't start. */
+            if (event.payload.code !== "invalid_state" && event.payload.code !== "budget_exhausted") {
+                appendToChat(`** ${htmlEscape(event.payload.request)} failed: ${htmlEscape(event.payload.message)} **`);
+            }
+            break;
+        case "ack":
+            break;
         default:
             alert("unsupported message type: " + event.type);
             break;
@@ -737,7 +903,8 @@ function appendToChat(message) {
 }
 
 function sendEvent(eventName, payload) {
-    const event = new Event(eventName, payload);
+    lastRequestId++;
+    const event = new Event(eventName, payload, String(lastRequestId));
     conn.send(JSON.stringify(event));
 }
 
@@ -787,6 +954,7 @@ function clueHandler(payload) {
 function login() {
     let formData = {
         "username": document.getElementById("username").value,
+        "password": document.getElementById("password").value,
     }
     /* Do not allow whitespace in username. This would break participants list,
        etc., where the username becomes part of a CSS identifier. */
@@ -804,11 +972,27 @@ function login() {
         room = defaultRoom;
     }
 
-    fetch("login", {
+    /* Registering creates the account, then logs in to it. */
+    let registered = Promise.resolve();
+    if (document.getElementById("register").checked) {
+        registered = fetch("register", {
+            method: 'post',
+            body: JSON.stringify(formData),
+            mode: 'cors'
+        }).then((response) => {
+            if (!response.ok) {
+                return response.text().then(
+                    (text) => {throw new Error(text)}
+                );
+            }
+        });
+    }
+
+    registered.then(() => fetch("login", {
         method: 'post',
         body: JSON.stringify(formData),
         mode: 'cors'
-    }).then((response) => {
+    })).then((response) => {
         if (response.ok) {
             return response.json();
         } else {
@@ -840,7 +1024,9 @@ function login() {
 function connectWebsocket(otp, room) {
     if (window["WebSocket"]) {
         // connect to ws
-        conn = new WebSocket("wss://" + document.location.host + "/ws?otp=" + otp);
+        /* Plain ws:// only when the page itself was served over plain HTTP. */
+        const scheme = document.location.protocol === "https:" ? "wss://" : "ws://";
+        conn = new WebSocket(scheme + document.location.host + "/ws?otp=" + otp);
 
         conn.onopen = function (evt) {
             document.getElementById("onconnect").hidden = false;
@@ -859,6 +1045,11 @@ function connectWebsocket(otp, room) {
         conn.onmessage = function(evt) {
             const eventData = JSON.parse(evt.data);
             const event = Object.assign(new Event, eventData);
+            /* The server numbers its events; a gap means we fell behind. */
+            if (event.seq > lastSeq + 1) {
+                appendToChat(`** Missed ${event.seq - lastSeq - 1} message(s). Reload if the game looks wrong. **`);
+            }
+            lastSeq = event.seq;
             routeEvent(event);
         }
     } else {
@@ -877,6 +1068,7 @@ function gameOverHandler(payload) {
     const turnElement = document.getElementById("turn");
     turnElement.innerHTML = "Game Over";
     turnElement.style.color = "black";
+    removeBotParticipants();
     resetAllParticipants();
     if (currentGame === null) {
         /* A non-player client in the chat room, waiting for the game to end. */
@@ -888,6 +1080,52 @@ function gameOverHandler(payload) {
     }
     revealUnguessedCards(msg.cards);
     appendToChat("** Game Over **");
+    if (msg.series) {
+        appendToChat(`** ${seriesSummary(msg.series)} **`);
+    }
+    if (msg.usage) {
+        appendToChat(`** The AI players used ${msg.usage.totalTokens} tokens in ${msg.usage.calls} calls **`);
+    }
+    if (currentGame !== null) {
+        document.getElementById("rematch").hidden = false;
+        saveGameRecord(msg);
+        document.getElementById("game-replay").href = `replay.html?id=${msg.gameId}`;
+        /* What the AI players were asked and answered, in games with them. */
+        const transcript = document.getElementById("bot-transcript");
+        transcript.href = `transcript?id=${msg.gameId}`;
+        transcript.hidden = !msg.usage;
+    }
+}
+
+/* Offer the key card and action log for download, for review. */
+function saveGameRecord({message, keyCard, log}) {
+    const record = JSON.stringify({message: message, keyCard: keyCard, log: log}, null, 2);
+    const link = document.getElementById("game-record");
+    if (link.href) {
+        URL.revokeObjectURL(link.href);
+    }
+    link.href = URL.createObjectURL(new Blob([record], {type: "application/json"}));
+}
+
+function percent(fraction) {
+    return `${Math.round(fraction * 100)}%`;
+}
+
+function showLeaderboard({leaderboard, player}) {
+    if (leaderboard === null || leaderboard.length === 0) {
+        return;
+    }
+    let msg = "** Leaderboard **";
+    leaderboard.forEach(({name, games, wins}, i) => {
+        msg += `<br>${i + 1}. ${htmlEscape(name)}: ${wins.cluegiver + wins.guesser} wins in ${games} games`;
+    });
+    if (player) {
+        const {clues, avgCardsPerClue, clueSuccessRate, assassinHits, guesses, guessAccuracy} = player;
+        msg += `<br>Your clues: ${clues}, ${avgCardsPerClue.toFixed(1)} cards per clue, ` +
+               `${percent(clueSuccessRate)} success, ${assassinHits} assassin hits.`;
+        msg += `<br>Your guesses: ${guesses}, ${percent(guessAccuracy)} accurate.`;
+    }
+    appendToChat(msg);
 }
 
 function invalidStateHandler(message) {
@@ -903,9 +1141,14 @@ window.onload = function() {
     document.getElementById("login-form").onsubmit = login;
     document.getElementById("newgame-button").onclick = requestNewGame;
     document.getElementById("abort-button").onclick = abortGame;
+    document.getElementById("rematch-button").onclick = requestRematch;
     document.getElementById("cluebox").onsubmit = giveClue;
     document.getElementById("end-turn").onclick = endTurn;
     document.getElementById("sort-cards").addEventListener("change", sortCards, false);
     document.getElementById("role").addEventListener("change", changeRole, false);
     document.getElementById("team").addEventListener("change", changeTeam, false);
+    fetch("bots")
+        .then((response) => response.ok ? response.json() : Promise.reject(response.statusText))
+        .then(setupBotSettings)
+        .catch((err) => console.log(`no bot settings: ${err}`));
 }
\ No newline at end of file
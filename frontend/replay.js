@@ -0,0 +1,98 @@
+"use strict";
+
+/* Step through a finished game fetched from the /replay endpoint.
+   The game ID is taken from the page URL: replay.html?id=<game ID> */
+
+const totalNumCards = 25;
+
+let replay = null;
+let step = 0;
+
+const gameBoard = document.getElementById("gameboard");
+for (let i = 0; i < totalNumCards; i++) {
+    const cardItem = document.createElement("div");
+    cardItem.className = "card";
+    cardItem.id = `card-${i}`;
+    gameBoard.appendChild(cardItem);
+}
+
+function describeStep({actor, team, role, action, detail, number, result, correct}) {
+    switch (action) {
+        case "start":
+            return `Game starts. ${team} ${role} goes first.`;
+        case "clue":
+            return `${actor} (${team}) gives clue ${detail}` + (number > 0 ? ` for ${number}` : "");
+        case "guess":
+            return `${actor} (${team}) uncovers ${detail}: ` + (correct ? "CORRECT" : `incorrect, card is ${result}`);
+        case "bot_response":
+            return `ChatBot ${role} (${team}) says: ${detail}`;
+        case "end_turn":
+            return `${actor} (${team}) ends the turn.`;
+        case "turn_change":
+            return `${team} ${role}'s turn.`;
+        case "leave":
+            return `${actor} leaves the game.`;
+        case "game_over":
+            return result ? result : "Game over.";
+        default:
+            return action;
+    }
+}
+
+function showStep() {
+    /* Cards guessed up to and including the current step. */
+    const guessed = new Set();
+    for (let i = 0; i <= step; i++) {
+        if (replay.steps[i].action === "guess") {
+            guessed.add(replay.steps[i].detail);
+        }
+    }
+    replay.board.forEach((word, i) => {
+        const card = document.getElementById(`card-${i}`);
+        const color = replay.keyCard[word];
+        card.innerText = word;
+        card.className = guessed.has(word) ? `card ${color} guessed` : `card ${color}`;
+    });
+
+    const current = replay.steps[step];
+    document.getElementById("step").innerText =
+        `${step + 1} / ${replay.steps.length}\n${describeStep(current)}`;
+    if (current.score) {
+        document.getElementById("redscore").innerText = current.score.red;
+        document.getElementById("bluescore").innerText = current.score.blue;
+    }
+    document.getElementById("prev-step").disabled = step === 0;
+    document.getElementById("next-step").disabled = step === replay.steps.length - 1;
+}
+
+function nextStep() {
+    if (step < replay.steps.length - 1) {
+        step++;
+        showStep();
+    }
+}
+
+function prevStep() {
+    if (step > 0) {
+        step--;
+        showStep();
+    }
+}
+
+window.onload = function() {
+    const id = new URLSearchParams(document.location.search).get("id");
+    const title = document.getElementById("replay-title");
+    document.getElementById("next-step").onclick = nextStep;
+    document.getElementById("prev-step").onclick = prevStep;
+
+    fetch(`replay?id=${encodeURIComponent(id)}`).then((response) => {
+        if (response.ok) {
+            return response.json();
+        }
+        return response.text().then((text) => {throw new Error(text)});
+    }).then((data) => {
+        replay = data;
+        title.innerText = `Room "${replay.room}", ${new Date(replay.started).toLocaleString()}`;
+        showStep();
+    }).catch((error) => { title.innerText = error });
+};
@@ -6,14 +6,21 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/rs/zerolog"
 )
 
 const totalNumCards = 25
 
 var (
+	/* An admin may reload the word list while games start. */
+	wordsMu    sync.RWMutex
 	wordList   []string
 	wordCount  int
+	/* Where the word list was read from, for reloading. */
+	wordListPath string
 )
 
 type Team string
@@ -151,6 +158,7 @@ type GameList map[string]*Game
 type Score    map[Team]int
 
 type Game struct {
+	id              string
 	name            string
 	players         ClientList
 	cards           Deck
@@ -160,8 +168,26 @@ type Game struct {
 	guessRemaining  int
 	score           Score
 	bot             *Bot
+	bots            BotActions
 	manager         *Manager
 	active          bool
+	winner          Team
+	cause           string
+	history         GameLog
+	/* Logs with the game ID and room. */
+	log             zerolog.Logger
+	/* Tokens the game's bots used. */
+	usage           Usage
+	transcript      []BotTurn
+}
+
+/* The request being handled in the game's room. Must be called on
+   the room's goroutine. */
+func (game *Game) request() string {
+	if room := game.manager.room(game.name); room != nil {
+		return room.request
+	}
+	return ""
 }
 
 func (game *Game) notifyPlayers(messageType string, message any) error {
@@ -169,9 +195,10 @@ func (game *Game) notifyPlayers(messageType string, message any) error {
 	if err != nil {
 		return err
 	}
+	outgoingEvent.RequestID = game.request()
 
 	for _, client := range game.players {
-		client.egress <- outgoingEvent
+		client.send(outgoingEvent)
 	}
 
 	return nil
@@ -182,16 +209,62 @@ func (game *Game) notifySomePlayers(team Team, role Role, messageType string, me
 	if err != nil {
 		return err
 	}
+	outgoingEvent.RequestID = game.request()
 
 	for _, client := range game.players {
 		if client.team == team && client.role == role {
-			client.egress <- outgoingEvent
+			client.send(outgoingEvent)
 		}
 	}
 
 	return nil
 }
 
+/* Deal the board to the players and let the bots take the first turn. */
+func (game *Game) start() error {
+	var series *SeriesEvent
+	if s := game.manager.roomSeries(game.name); s != nil {
+		series = s.score()
+	}
+
+	cluegiverMessage := NewGameResponseEvent {
+		GameID: game.id,
+		Cards: game.cards,
+		TeamTurn: game.teamTurn,
+		Series: series,
+		Bots: game.botParticipants(),
+	}
+	cluegiverEvent, err := packageMessage(EventNewGame, cluegiverMessage)
+	if err != nil {
+		return err
+	}
+
+	guesserMessage := NewGameResponseEvent {
+		GameID: game.id,
+		Cards: game.cards.whiteCards(),
+		TeamTurn: game.teamTurn,
+		Series: series,
+		Bots: game.botParticipants(),
+	}
+	guesserEvent, err := packageMessage(EventNewGame, guesserMessage)
+	if err != nil {
+		return err
+	}
+
+	/* Send appropriately colored cards based on role. */
+	cluegiverEvent.RequestID = game.request()
+	guesserEvent.RequestID = game.request()
+	for _, player := range game.players {
+		if player.role == cluegiver {
+			player.send(cluegiverEvent)
+		} else {
+			player.send(guesserEvent)
+		}
+	}
+
+	return game.botPlay(GiveClueEvent{})
+}
+
 func (game *Game) changeTurn() {
 	game.roleTurn = game.roleTurn.Change()
 	if game.actions.teamCount() == 1 {
@@ -231,25 +304,103 @@ func (game *Game) evaluateGuess(cardColor string) bool {
 	return correct
 }
 
-func (game *Game) makeBot(ba *BotActions) {
+/* Bots are refused, with the reason, once their budget is used up. */
+func (game *Game) makeBot(ba *BotActions) error {
 	if ba != nil &&
 	   (ba.hasAction(cluegiver) || ba.hasAction(guesser)) {
+		if game.manager != nil {
+			if err := game.manager.usage.allow(game.name, time.Now()); err != nil {
+				game.log.Warn().Err(err).Msg("bots refused")
+				return err
+			}
+		}
 		game.bot = NewBot(game, ba)
 	}
+	return nil
+}
+
+/* The game's bots as participants, one per seat, with their settings. */
+func (game *Game) botParticipants() []Participant {
+	participants := []Participant{}
+	for _, seat := range game.bots.Seats {
+		seat := seat
+		participants = append(participants, Participant{
+			Name:   fmt.Sprintf("%v-%v-%v", botName, seat.Team, seat.Role),
+			Team:   seat.Team,
+			Role:   seat.Role,
+			InGame: true,
+			Bot:    &seat,
+		})
+	}
+	return participants
 }
 
-func (game *Game) botPlay(clue GiveClueEvent) error {
+/* Whether the bots' budget ran out during the game, which stops them.
+   If players share every seat the bots had, the game goes on without
+   the bots' suggestions; otherwise nobody is left to take the bots'
+   turns, and the game ends. Either way, players are told why. */
+func (game *Game) stopBotsOverBudget() bool {
+	if game.manager == nil {
+		return false
+	}
+	err := game.manager.usage.allow(game.name, time.Now())
+	if err == nil {
+		return false
+	}
+	game.log.Warn().Err(err).Msg("bots stopped")
+	/* Only players count: actions include the bots. */
+	shared := true
+	for _, seat := range game.bots.Seats {
+		humans := 0
+		for _, player := range game.players {
+			if player.team == seat.Team && player.role == seat.Role {
+				humans++
+			}
+		}
+		if humans == 0 {
+			shared = false
+		}
+	}
+	if shared {
+		game.bot = nil
+		game.notifyPlayers(EventInvalidState, err.Error())
+		return true
+	}
+	game.cause = OutcomeOverBudget
+	game.removeGame(err.Error())
+	return true
+}
+
+func (game *Game) botPlay(clue GiveClueEvent) (err error) {
 	if game.bot == nil {
 		return nil
 	}
+	/* Before each call to the bots' LLM. */
+	if game.bot.actions.hasTeamAction(game.teamTurn, game.roleTurn) && game.stopBotsOverBudget() {
+		return nil
+	}
+	_, end := game.startSpan("botPlay")
+	defer func() { end(err) }()
 	eventType, clueStruct, team, role := game.bot.Play(clue)
 	if eventType == "" || clueStruct == nil {
 		// TODO: better handling of missing bot response. Retry?
 		return nil
 	}
+	turn := game.addBotTurn(newBotTurn(clueStruct, team, role, game.bot))
+	if eventType == EventGiveClue && clueStruct.err != nil {
+		return clueStruct.err
+	}
+	game.record(LogEntry{
+		Actor: botName,
+		Team: team,
+		Role: role,
+		Action: LogBot,
+		Detail: clueStruct.response,
+	})
 	/* If human players share this role, tell them the bot's
 	   suggestion. Do not play for them. */
 	if game.actions[team][role] > 1 {
+		game.transcript[turn].Suggested = true
 		message := NewMessageEvent {
 			SentTime: time.Now(),
 			SendMessageEvent: SendMessageEvent {
@@ -283,6 +434,8 @@ func (game *Game) botPlay(clue GiveClueEvent) error {
 				},
 				TeamColor: team,
 			}
+			/* Before the guess, which may end the game and save it. */
+			game.transcript[turn].Played = append(game.transcript[turn].Played, guess)
 			if !GuessEvaluation(guessResponse, game.bot.client) {
 				/* Incorrect guess, or game over. */
 				if game != nil && game.active {
@@ -309,6 +462,7 @@ func (game *Game) botPlay(clue GiveClueEvent) error {
 			From: "ChatBot",
 			TeamColor: game.teamTurn,
 		}
+		game.transcript[turn].Played = []string{clueStruct.word}
 		evt, err := packageMessage(eventType, e)
 		if err != nil {
 			return err
@@ -327,44 +481,78 @@ func (game *Game) validGame() bool {
 
 func (game *Game) removePlayer(name string) {
 	if player, exists := game.players[name]; exists {
+		game.record(LogEntry{
+			Actor: name,
+			Team: player.team,
+			Role: player.role,
+			Action: LogLeave,
+		})
 		player.game = nil
 		game.actions[player.team][player.role] -= 1
 		delete(game.players, name)
 	}
+	/* Nobody is left: end the game, which archives it if it was
+	   still being played. */
 	if len(game.players) == 0 {
-		delete(game.manager.games, game.name)
+		if game.active {
+			game.cause = OutcomeAbandoned
+		}
+		game.removeGame()
 	}
 }
 
 func (game *Game) removeGame(message ...string) bool {
+	/* The room may have started another game since. */
+	if game.manager.game(game.name) != game {
+		return false
+	}
 	return game.manager.removeGame(game.name, message...)
 }
 
 
+/* Read the word list, unless one has been read already. */
 func readWordList(filePath string) error {
-	if len(wordList) == 0 {
-		file, err := os.Open(filePath)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+	wordsMu.RLock()
+	loaded := len(wordList) > 0
+	wordsMu.RUnlock()
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			word := scanner.Text()
-			wordList = append(wordList, strings.ToUpper(word))
-		}
-		wordCount = len(wordList)
-		if wordCount < 25 {
-			return fmt.Errorf("word list contains less than 25 words")
-		}
+	if loaded {
+		return nil
+	}
+	_, err := reloadWordList(filePath)
+	return err
+}
 
-		if err := scanner.Err(); err != nil {
-			return err
-		}
+/* Replace the word list with the one in the file, if that one is
+   usable. Returns the number of words. Games in progress keep their
+   cards. */
+func reloadWordList(filePath string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
 	}
+	defer file.Close()
 
-	return nil
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := scanner.Text()
+		words = append(words, strings.ToUpper(word))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if len(words) < totalNumCards {
+		return 0, fmt.Errorf("word list contains less than %v words", totalNumCards)
+	}
+
+	wordsMu.Lock()
+	defer wordsMu.Unlock()
+
+	wordList = words
+	wordCount = len(words)
+	wordListPath = filePath
+	return wordCount, nil
 }
 
 func getCards() Deck {
@@ -373,6 +561,9 @@ func getCards() Deck {
 	    "blue", "blue", "blue", "blue", "blue", "blue", "blue", "blue",
 	    "black",
 	    "neutral", "neutral", "neutral", "neutral", "neutral", "neutral", "neutral"}
+	wordsMu.RLock()
+	defer wordsMu.RUnlock()
+
 	cards := make(Deck, totalNumCards)
 	for i := 0; i < totalNumCards; i++ {
 		word := wordList[rand.Intn(wordCount)]
@@ -524,7 +524,7 @@ func TestBotPlay(t *testing.T) {
 	response := "Clue: Measure\nNumber of words that " +
 		"match the clue: 3\nWords that match the clue: " +
 		"SCALE, WATCH, MAPLE"
-	askGPT3Dot5Bot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+	askLLMBot = func (bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
 		return openai.ChatCompletionResponse{
 			Choices: []openai.ChatCompletionChoice{
 				{
@@ -569,4 +569,126 @@ func TestBotPlay(t *testing.T) {
 	if c != expect {
 		t.Errorf("Expected: %#v\nGot: %#v", expect, c)
 	}
-}
\ No newline at end of file
+}
+
+/* Play a clue and two guesses, the second of which hits the
+   death card, and check the game log. */
+func TestGameLog(t *testing.T) {
+	manager := setupDeck(t, nil, nil)
+	game := manager.games["test"]
+	client1 := manager.clients["testClient1"]
+	client2 := manager.clients["testClient2"]
+	drainEgress(t, client1, client2)
+
+	clue, _ := json.Marshal(map[string]string{
+		"clue": "hint",
+		"numCards": "1",
+		"from": "testClient2",
+		"teamColor": "red",
+	})
+	if err := ClueHandler(Event{Type: EventGiveClue, Payload: clue}, client2); err != nil {
+		t.Fatalf("clue failed: %v", err)
+	}
+	for _, word := range []string{"redword", "deathword"} {
+		guess, _ := json.Marshal(GuessEvent{Guess: word, Guesser: "testClient1"})
+		if err := GuessEvaluationHandler(Event{Type: EventMakeGuess, Payload: guess}, client1); err != nil {
+			t.Fatalf("guess %v failed: %v", word, err)
+		}
+	}
+
+	expect := []string{LogStart, LogClue, LogGuess, LogGuess, LogTurnChange, LogGameOver}
+	if len(game.history) != len(expect) {
+		t.Fatalf("expected %v log entries, got %v: %#v", len(expect), len(game.history), game.history)
+	}
+	for i, action := range expect {
+		if game.history[i].Action != action {
+			t.Errorf("entry %v: expected %v, got %v", i, action, game.history[i].Action)
+		}
+	}
+
+	if e := game.history[1]; e.Actor != "testClient2" || e.Detail != "hint" || e.Number != 1 || e.Role != cluegiver {
+		t.Errorf("unexpected clue entry: %#v", e)
+	}
+	if e := game.history[2]; e.Actor != "testClient1" || e.Detail != "redword" || e.Result != "red" || !e.Correct {
+		t.Errorf("unexpected guess entry: %#v", e)
+	}
+	if e := game.history[2]; e.Score[red] != 8 || e.Score[blue] != 8 {
+		t.Errorf("score after guess: expected red 8, blue 8, got %v", e.Score)
+	}
+	if e := game.history[3]; e.Result != deathCard || e.Correct {
+		t.Errorf("unexpected guess entry: %#v", e)
+	}
+	if e := game.history[5]; e.Team != blue || !strings.Contains(e.Result, "Black Card") {
+		t.Errorf("unexpected game over entry: %#v", e)
+	}
+	for i := 1; i < len(game.history); i++ {
+		if game.history[i].Time.Before(game.history[i-1].Time) {
+			t.Errorf("entry %v is out of order", i)
+		}
+	}
+
+	data, err := game.history.JSON()
+	if err != nil {
+		t.Fatalf("could not marshal log: %v", err)
+	}
+	var decoded GameLog
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("could not unmarshal log: %v", err)
+	}
+	if len(decoded) != len(game.history) {
+		t.Fatalf("log did not survive a round trip: %v", string(data))
+	}
+	for i := range decoded {
+		if !decoded[i].Time.Equal(game.history[i].Time) {
+			t.Errorf("entry %v: time changed in round trip", i)
+		}
+		/* Compare everything else. */
+		decoded[i].Time = game.history[i].Time
+		if !reflect.DeepEqual(decoded[i], game.history[i]) {
+			t.Errorf("entry %v: expected %#v, got %#v", i, game.history[i], decoded[i])
+		}
+	}
+
+	key := game.cards.keyCard()
+	if key["deathword"] != deathCard || key["redword"] != "red" {
+		t.Errorf("unexpected key card: %v", key)
+	}
+}
+
+/* A game everyone leaves is over, and is kept like any other. */
+func TestAbandonedGame(t *testing.T) {
+	manager := setupGame(t, nil, nil)
+	manager.makeChatRoom("test")
+	game := manager.games["test"]
+
+	game.removePlayer("testClient1")
+	if manager.games["test"] != game || !game.active {
+		t.Fatal("game ended with a player left")
+	}
+	game.removePlayer("testClient2")
+	if manager.games["test"] != nil || game.active {
+		t.Error("game not removed after everyone left")
+	}
+	record, err := manager.store.Get(game.id)
+	if err != nil {
+		t.Fatalf("abandoned game not archived: %v", err)
+	}
+	if record.Cause != OutcomeAbandoned {
+		t.Errorf("cause: %v", record.Cause)
+	}
+
+	/* The last player out may also abort, and abort again. */
+	manager = setupGame(t, nil, nil)
+	manager.makeChatRoom("test")
+	game = manager.games["test"]
+	client2 := manager.clients["testClient2"]
+	game.removePlayer("testClient1")
+	for i := 0; i < 2; i++ {
+		if err := AbortGameHandler(Event{Type: EventAbortGame}, client2); err != nil {
+			t.Errorf("abort %v: %v", i, err)
+		}
+	}
+	if manager.games["test"] != nil || game.active {
+		t.Error("game not removed after the last player aborted")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+/* Kinds of entries in a game log. */
+const (
+	LogStart      = "start"
+	LogClue       = "clue"
+	LogGuess      = "guess"
+	LogBot        = "bot_response"
+	LogEndTurn    = "end_turn"
+	LogTurnChange = "turn_change"
+	LogLeave      = "leave"
+	LogGameOver   = "game_over"
+)
+
+/* Actor for entries that are not caused by a player. */
+const serverActor = "server"
+
+/* One thing that happened in a game. Detail holds the clue word,
+   the guessed word or the bot's raw response; Result holds the
+   color of a guessed card or the outcome of the game. Score is
+   the number of cards left to each team after the action. */
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Team    Team      `json:"team,omitempty"`
+	Role    Role      `json:"role,omitempty"`
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
+	Number  int       `json:"number,omitempty"`
+	Result  string    `json:"result,omitempty"`
+	Correct bool      `json:"correct,omitempty"`
+	Score   Score     `json:"score,omitempty"`
+}
+
+/* Ordered record of every action in a game. */
+type GameLog []LogEntry
+
+func (l GameLog) JSON() ([]byte, error) {
+	return json.Marshal(l)
+}
+
+func (game *Game) record(entry LogEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Score = Score{
+		red:  game.score[red],
+		blue: game.score[blue],
+	}
+	game.history = append(game.history, entry)
+}
+
+func (game *Game) recordTurnChange() {
+	game.record(LogEntry{
+		Actor: serverActor,
+		Team: game.teamTurn,
+		Role: game.roleTurn,
+		Action: LogTurnChange,
+	})
+}
+
+/* The board as dealt, with every card's color, guessed or not. */
+func (d Deck) keyCard() Deck {
+	key := make(Deck, len(d))
+	for card, color := range d {
+		key[card] = strings.TrimPrefix(color, "guessed-")
+	}
+	return key
+}
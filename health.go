@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/* Set at build time: go build -ldflags "-X main.version=v1.2.3".
+   Otherwise /version reports what the Go toolchain recorded. */
+var version = ""
+
+const (
+	/* How long a check that the LLM is reachable is remembered, so
+	   that readiness probes don't each call the provider. */
+	llmProbeInterval = time.Minute
+	llmProbeTimeout  = 5 * time.Second
+)
+
+/* Whether the bots' LLM provider answers. Stored in a var so it can
+   be overridden for testing. */
+var probeLLM = func(ctx context.Context) error {
+	provider := botLLM()
+	if provider == nil {
+		return fmt.Errorf("no LLM provider %q", botProvider)
+	}
+	return provider.Ping(ctx)
+}
+
+/* The last check that the LLM is reachable. */
+type llmProbe struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (p *llmProbe) check(ctx context.Context) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if time.Since(p.checked) < llmProbeInterval {
+		return p.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, llmProbeTimeout)
+	defer cancel()
+	p.err = probeLLM(ctx)
+	p.checked = time.Now()
+	return p.err
+}
+
+/* The process is up: GET /healthz */
+func (m *Manager) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+type readiness struct {
+	Ready    bool         `json:"ready"`
+	WordList bool         `json:"wordList"`
+	Listener bool         `json:"listener"`
+	/* The server is shutting down. */
+	Closing  bool         `json:"closing"`
+	LLM      llmReadiness `json:"llm"`
+}
+
+/* Bots need the LLM, but games without bots don't, so the LLM is
+   reported without holding up readiness. */
+type llmReadiness struct {
+	KeyConfigured bool   `json:"keyConfigured"`
+	/* Only checked when asked for, with /readyz?llm=1. */
+	Reachable     *bool  `json:"reachable,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+/* Ready for players once the word list is loaded and the listener
+   is up, until shutdown starts: GET /readyz */
+func (m *Manager) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	wordsMu.RLock()
+	words := len(wordList)
+	wordsMu.RUnlock()
+
+	status := readiness{
+		WordList: words > 0,
+		Listener: m.listening.Load(),
+		Closing:  m.closing.Load(),
+		LLM: llmReadiness{
+			KeyConfigured: botLLM() != nil && botLLM().Configured(),
+		},
+	}
+	status.Ready = status.WordList && status.Listener && !status.Closing
+
+	if r.URL.Query().Get("llm") != "" && status.LLM.KeyConfigured {
+		err := m.llm.check(m.ctx)
+		reachable := err == nil
+		status.LLM.Reachable = &reachable
+		if err != nil {
+			status.LLM.Error = err.Error()
+		}
+	}
+
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, code, status)
+}
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: version}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = bi.GoVersion
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+/* What was built, from what: GET /version */
+func (m *Manager) versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, readBuildInfo())
+}
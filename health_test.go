@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+
+	readyz := func(query string) (int, readiness) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		manager.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz"+query, nil))
+		var status readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("bad readiness: %v", err)
+		}
+		return w.Code, status
+	}
+
+	if code, status := readyz(""); code != http.StatusServiceUnavailable || status.Ready || !status.WordList || status.Listener {
+		t.Errorf("before listening: %v, %+v", code, status)
+	}
+	manager.listening.Store(true)
+	if code, status := readyz(""); code != http.StatusOK || !status.Ready {
+		t.Errorf("listening: %v, %+v", code, status)
+	}
+
+	/* The LLM is only checked when asked, and at most once a minute. */
+	defer func(providers map[string]LLMProvider, probe func(context.Context) error) {
+		llmProviders, probeLLM = providers, probe
+	}(llmProviders, probeLLM)
+	openAI, _ := NewOpenAIProvider(ProviderConfig{Key: "sk-test"})
+	llmProviders = map[string]LLMProvider{defaultProvider: openAI}
+	probes := 0
+	probeLLM = func(ctx context.Context) error {
+		probes++
+		return errors.New("connection refused")
+	}
+	if _, status := readyz(""); !status.LLM.KeyConfigured || status.LLM.Reachable != nil || probes != 0 {
+		t.Errorf("LLM checked without asking: %+v", status.LLM)
+	}
+	code, status := readyz("?llm=1")
+	if code != http.StatusOK || status.LLM.Reachable == nil || *status.LLM.Reachable || status.LLM.Error == "" {
+		t.Errorf("unreachable LLM: %v, %+v", code, status.LLM)
+	}
+	readyz("?llm=1")
+	if probes != 1 {
+		t.Errorf("LLM checked %v times", probes)
+	}
+
+	manager.closing.Store(true)
+	if code, status := readyz(""); code != http.StatusServiceUnavailable || !status.Closing {
+		t.Errorf("closing: %v, %+v", code, status)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	manager := NewManager(context.Background())
+	defer func(v string) { version = v }(version)
+	version = "v9.9.9"
+
+	w := httptest.NewRecorder()
+	manager.versionHandler(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var info buildInfo
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if w.Code != http.StatusOK || info.Version != "v9.9.9" || info.GoVersion == "" {
+		t.Errorf("version: %v, %+v", w.Code, info)
+	}
+}
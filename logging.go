@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+/* How log lines are written: one JSON object per line for log
+   collectors, or coloured text for people. */
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+)
+
+/* Set the level and format of the global logger, which the client
+   and game loggers are made from. */
+func setupLogging(level string, format string, out io.Writer) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || lvl == zerolog.NoLevel {
+		return fmt.Errorf("invalid log level: %v", level)
+	}
+	switch format {
+	case LogFormatJSON:
+	case LogFormatConsole:
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	default:
+		return fmt.Errorf("invalid log format: %v", format)
+	}
+	zerolog.SetGlobalLevel(lvl)
+	log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	return nil
+}
+
+/* The client's logger, with its current room. */
+func (c *Client) logger() *zerolog.Logger {
+	l := c.log.With().Str("room", c.room()).Logger()
+	return &l
+}
+
+/* A logger for handling one of the client's events: who sent it,
+   where, in which game, and what it was. */
+func (c *Client) eventLogger(event Event) *zerolog.Logger {
+	room := c.room()
+	ctx := c.log.With().Str("room", room).Str("event", event.Type)
+	if game := c.manager.game(room); game != nil {
+		ctx = ctx.Str("game", game.id)
+	}
+	if event.RequestID != "" {
+		ctx = ctx.Str("requestId", event.RequestID)
+	}
+	l := ctx.Logger()
+	return &l
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestEventLogger(t *testing.T) {
+	defer func(logger zerolog.Logger, level zerolog.Level) {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	}(log.Logger, zerolog.GlobalLevel())
+	var out bytes.Buffer
+	if err := setupLogging("info", LogFormatJSON, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	alice := NewClient("alice", nil, manager)
+	bob := NewClient("bob", nil, manager)
+	bob.role = cluegiver
+	manager.addClient(alice)
+	manager.addClient(bob)
+	room, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, alice)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, bob)
+	manager.routeEvent(Event{Type: EventNewGame, Payload: json.RawMessage(`{}`)}, alice)
+	game := manager.game("den")
+
+	out.Reset()
+	manager.routeEvent(Event{Type: EventMakeGuess, Payload: json.RawMessage(`{}`), RequestID: "a7"}, alice)
+	var line map[string]any
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("expected one JSON log line, got %q", out.String())
+	}
+	want := map[string]any{
+		"level":     "warn",
+		"user":      "alice",
+		"room":      "den",
+		"game":      game.id,
+		"event":     EventMakeGuess,
+		"requestId": "a7",
+		"code":      ErrCodeNotYourTurn,
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%v: expected %v, got %v", key, value, line[key])
+		}
+	}
+
+	/* Bot transcripts are only logged at debug. */
+	out.Reset()
+	game.log.Debug().Msg("transcript")
+	if strings.Contains(out.String(), "transcript") {
+		t.Errorf("debug line logged at info: %q", out.String())
+	}
+	if err := setupLogging("verbose", LogFormatJSON, &out); err == nil {
+		t.Error("invalid log level accepted")
+	}
+}
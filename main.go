@@ -2,43 +2,99 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"io"
+	"errors"
+	"flag"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-var (
-	token string
-	verbose bool
-)
-
 const (
 	defaultChatRoom = "lobby"
 	deathCard       = "black"
 )
 
 func main() {
-	/* Log ChatGPT responses */
-	verbose = true
+	cfg, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+	cfg.apply()
+
+	if llmProviders, err = setupProviders(cfg); err != nil {
+		log.Fatal().Err(err).Msg("LLM provider error")
+	}
+	if !botLLM().Configured() {
+		log.Warn().Str("provider", botProvider).Str("keyFile", cfg.GPTKeyFile).
+			Msg("no API key for the bots' LLM provider; bots will not play")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	token = getGPTToken("external/gpt-secretkey.txt")
-	setupAPI()
-	log.Fatal().Err(http.ListenAndServeTLS(
-		":8080", "external/server.crt", "external/server.key", nil))
+	/* The manager's own context outlives the signal, so that
+	   shutdown can wait for bot calls before cancelling them. */
+	manager := setupAPI(cfg)
+	stopTracing, err := setupTracing(ctx, cfg, manager.id)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not set up tracing")
+	}
+	server := &http.Server{Addr: cfg.Addr}
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not listen")
+	}
+	go func() {
+		var err error
+		if cfg.TLS {
+			err = server.ServeTLS(listener, cfg.CertFile, cfg.KeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("server error")
+		}
+	}()
+	manager.listening.Store(true)
+	log.Info().Str("addr", cfg.Addr).Bool("tls", cfg.TLS).Str("version", readBuildInfo().Version).
+		Msg("server started")
+
+	<-ctx.Done()
+	stop()
+	log.Info().Msg("shutting down")
+
+	/* A little longer than the bot wait, to save games and say goodbye. */
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), botShutdownWait + 5*time.Second)
+	defer cancel()
+	manager.Shutdown(shutdownCtx)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("server shutdown")
+	}
+	if err := stopTracing(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("could not flush traces")
+	}
 }
 
 /* CodeNames as a Service: If you wanted to make this S C A L E...
-   At the point where you start running multiple instances, it is common to include
-   Redis or RabbitMQ to allow distributed messages for the websockets.
-   You would then listen on the PubSub schema used and push messages on RabbitMQ/Redis,
-   then read from those topics and push onto the Websockets. */
-func setupAPI() {
+   Run several instances with -broker pointing at a shared Redis
+   server. Rooms are spread over the instances, and messages for
+   the websockets go through Redis pub/sub (see cluster.go). */
+func setupAPI(cfg *Config) *Manager {
 	ctx := context.Background()
 
-	if _, err := os.Stat("external/wordlist.txt"); err == nil {
+	if cfg.WordList != "" {
+		if err := readWordList(cfg.WordList); err != nil {
+			log.Fatal().Err(err).Msg("wordlist error")
+		}
+	} else if _, err := os.Stat("external/wordlist.txt"); err == nil {
 		/* For use with Docker container. May choose to put custom
 		   wordlist in external volume mounted to container,
 		   overriding the default wordlist. */
@@ -54,25 +110,78 @@ func setupAPI() {
 	}
 
 
-	manager := NewManager(ctx)
+	var broker Broker = NewLocalBroker()
+	if cfg.Broker != "local" {
+		redisBroker, err := OpenRedisBroker(cfg.Broker)
+		if err != nil {
+			log.Fatal().Err(err).Msg("broker error")
+		}
+		broker = redisBroker
+	}
+	var otps OTPStore
+	switch {
+	case cfg.OTPStore == "token":
+		/* Other instances must see spent tokens. */
+		var replays Broker
+		if cfg.Broker != "local" {
+			replays = broker
+		}
+		key, err := readTokenKey(cfg.TokenKey, cfg.TokenKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("token key error")
+		}
+		tokens, err := NewTokenStore(key, otpLifetime, replays)
+		if err != nil {
+			log.Fatal().Err(err).Msg("token key error")
+		}
+		otps = tokens
+	case cfg.OTPStore == "shared" || (cfg.OTPStore == "" && cfg.Broker != "local"):
+		otps = NewSharedOTPStore(broker, otpLifetime)
+	}
+	manager, err := NewManagerWithBroker(ctx, broker, cfg.InstanceID, otps)
+	if err != nil {
+		log.Fatal().Err(err).Msg("broker error")
+	}
+
+	/* Completed games are kept in the external volume so they
+	   survive a restart. Fall back to memory if it isn't writable. */
+	if store, err := OpenBoltStore(cfg.GameStore); err != nil {
+		log.Error().Err(err).Msg("game history will not be saved across restarts")
+	} else {
+		manager.store = store
+		manager.accounts = store
+	}
 
-	http.Handle("/", http.FileServer(http.Dir("./frontend")))
+	http.Handle("/", http.FileServer(http.Dir(cfg.FrontendDir)))
 	http.HandleFunc("/ws", manager.serveWS)
 	http.HandleFunc("/login", manager.loginHandler)
-}
+	http.HandleFunc("/healthz", manager.healthzHandler)
+	http.HandleFunc("/readyz", manager.readyzHandler)
+	http.HandleFunc("/version", manager.versionHandler)
+	http.HandleFunc("/register", manager.registerHandler)
+	http.HandleFunc("/account", manager.accountHandler)
+	http.HandleFunc("/replay", manager.replayHandler)
+	http.HandleFunc("/transcript", manager.transcriptHandler)
+	http.HandleFunc("/bots", manager.botCatalogHandler)
+	http.HandleFunc("/games", manager.gamesHandler)
+	http.HandleFunc("/stats", manager.statsHandler)
+	http.Handle("/metrics", manager.metricsHandler())
 
-func getGPTToken(path string) string {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Error().Err(err).Msg(fmt.Sprintf("Error opening %v", path))
-		return ""
-	}
-	defer file.Close() // Close the file when we're done
+	manager.usage.setBudgets(Budgets{Daily: cfg.LLMDailyBudget, Room: cfg.LLMRoomBudget})
 
-	pword, err := io.ReadAll(file)
+	adminToken, err := readAdminToken(cfg.AdminToken, cfg.AdminTokenFile)
 	if err != nil {
-		log.Error().Err(err).Msg(fmt.Sprintf("Error reading %v", path))
-		return ""
+		log.Fatal().Err(err).Msg("admin token error")
 	}
-	return string(pword)
+	manager.adminToken = adminToken
+	http.HandleFunc("/admin/rooms", manager.admin(manager.adminRoomsHandler))
+	http.HandleFunc("/admin/games", manager.admin(manager.adminGamesHandler))
+	http.HandleFunc("/admin/kick", manager.admin(manager.adminKickHandler))
+	http.HandleFunc("/admin/end-game", manager.admin(manager.adminEndGameHandler))
+	http.HandleFunc("/admin/notice", manager.admin(manager.adminNoticeHandler))
+	http.HandleFunc("/admin/reload-words", manager.admin(manager.adminReloadWordsHandler))
+	http.HandleFunc("/admin/usage", manager.admin(manager.adminUsageHandler))
+	http.HandleFunc("/admin/transcript", manager.admin(manager.adminTranscriptHandler))
+	http.HandleFunc("/admin/budgets", manager.admin(manager.adminBudgetsHandler))
+	return manager
 }
@@ -8,11 +8,16 @@ import (
 	"maps"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -26,27 +31,118 @@ type Manager struct {
 	clients  ClientList
 	chats    ChatRooms
 	games    GameList
+	series   SeriesList
 	handlers EventHandlerList
+	store    GameStore
+	accounts AccountStore
+	/* Player statistics over the store's games. */
+	stats    statsCache
 
 	sync.RWMutex
 
-	otps RetentionMap
+	otps OTPStore
+
+	/* Messages dropped and clients evicted because
+	   their outbound queues were full. */
+	droppedMessages atomic.Uint64
+	evictedClients  atomic.Uint64
+
+	/* Abuse protection: logins per address, events dropped for
+	   exceeding their budgets, and clients banned for flooding. */
+	loginLimiter    *rateLimiter
+	/* New chat rooms per client. */
+	roomLimiter     *rateLimiter
+	bans            banList
+	throttledEvents atomic.Uint64
+	bannedClients   atomic.Uint64
+
+	/* This instance, and how it shares rooms with other instances.
+	   Remote clients are the users of other instances in rooms
+	   owned by this one. */
+	id          string
+	broker      Broker
+	remote      ClientList
+	owners      ownerCache
+	unsubscribe func()
+
+	/* Cancelled at shutdown, stopping bot calls and OTP retention. */
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closing  atomic.Bool
+	botCalls atomic.Int64
+
+	metrics *metrics
+	/* Bearer token for the admin API; empty disables it. */
+	adminToken string
+
+	/* For readiness: the HTTP listener is up, and the LLM answers. */
+	listening atomic.Bool
+	llm       llmProbe
+	/* Tokens the bots used, and may use. */
+	usage     usageLedger
 }
 
+/* A manager for a single server instance. */
 func NewManager(ctx context.Context) *Manager {
+	m, _ := NewManagerWithBroker(ctx, NewLocalBroker(), "", nil)
+	return m
+}
+
+/* A manager that shares rooms with other instances through the
+   broker. An empty id picks a random one, and a nil OTP store keeps
+   logins in memory. */
+func NewManagerWithBroker(ctx context.Context, broker Broker, id string, otps OTPStore) (*Manager, error) {
+	if id == "" {
+		id = uuid.NewString()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if otps == nil {
+		otps = NewRetentionMap(ctx, otpLifetime)
+	}
 	m := &Manager{
+		ctx:      ctx,
+		cancel:   cancel,
+		id:       id,
+		broker:   broker,
+		remote:   make(ClientList),
+		owners:   ownerCache{owners: make(map[string]cachedOwner)},
 		clients:  make(ClientList),
 		chats:    make(ChatRooms),
 		games:    make(GameList),
+		series:   make(SeriesList),
 		handlers: make(EventHandlerList),
-		otps:     NewRetentionMap(ctx, 5*time.Second),
+		otps:     otps,
+
+		loginLimiter: newRateLimiter(loginLimit),
+		roomLimiter:  newRateLimiter(roomLimit),
+		bans:         banList{until: make(map[string]time.Time)},
 	}
+	store := NewMemoryStore(memoryStoreGames)
+	m.store, m.accounts = store, store
+	m.metrics = newMetrics(m)
 
 	m.setupEventHandlers()
 
 	m.makeChatRoom(defaultChatRoom)
 
-	return m
+	unsubscribe, err := broker.Subscribe(instanceTopic(id), m.receive)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	unsubscribeReleased, err := broker.Subscribe(releasedTopic, m.released)
+	if err != nil {
+		unsubscribe()
+		cancel()
+		return nil, err
+	}
+	m.unsubscribe = func() {
+		unsubscribe()
+		unsubscribeReleased()
+	}
+	go m.renewClaims()
+
+	return m, nil
 }
 
 func (m *Manager) setupEventHandlers() {
@@ -59,6 +155,8 @@ func (m *Manager) setupEventHandlers() {
 	m.handlers[EventGiveClue]    = ClueHandler
 	m.handlers[EventAbortGame]   = AbortGameHandler
 	m.handlers[EventEndTurn]     = EndTurnHandler
+	m.handlers[EventRematch]     = RematchHandler
+	m.handlers[EventGetStats]    = StatsHandler
 }
 
 func NewGameHandler(event Event, c *Client) error {
@@ -66,53 +164,132 @@ func NewGameHandler(event Event, c *Client) error {
 
 	var gameRequest NewGameRequestEvent
 	if err := json.Unmarshal(event.Payload, &gameRequest); err != nil {
-		return fmt.Errorf("bad payload in request: %v", err)
+		return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
 	}
 
 	/* All clients in the chat room at the time of
 	   game creation are added as players. */
-	game, err := m.makeGame(c.chatroom, m.chats[c.chatroom], &gameRequest.Bots)
-	/* Ensure game was created (valid initial state). */
+	room := m.room(c.chatroom)
+	if room == nil {
+		return requestError(ErrCodeNoRoom, "chat room %v does not exist", c.chatroom)
+	}
+	game, err := m.makeGame(c.chatroom, room.clients, &gameRequest.Bots)
+	/* Ensure game was created (valid initial state). A game in
+	   progress, and its series, carry on. */
+	if errorCode(err) == ErrCodeGameInProgress {
+		return err
+	}
 	if err != nil {
-		m.notifyClients(c.chatroom, EventInvalidState,
-			"Need one guesser and one cluegiver per team.")
-		return fmt.Errorf("invalid game state requested")
+		return m.refuseGame(c.chatroom, err)
 	}
 
-	cluegiverMessage := NewGameResponseEvent {
-		Cards: game.cards,
-		TeamTurn: game.teamTurn,
+	/* A new game request starts a new series (or a single game). */
+	if gameRequest.BestOf > 1 {
+		m.setSeries(c.chatroom, NewSeries(gameRequest.BestOf))
+	} else {
+		m.setSeries(c.chatroom, nil)
 	}
-	cluegiverEvent, err := packageMessage(EventNewGame, cluegiverMessage)
-	if err != nil {
-		return err
+
+	return game.start()
+}
+
+func RematchHandler(event Event, c *Client) error {
+	m := c.manager
+
+	game := m.game(c.chatroom)
+	if game == nil {
+		return requestError(ErrCodeNoGame, "Game %v not found", c.chatroom)
+	}
+	if game.active {
+		return requestError(ErrCodeGameInProgress, "game %v is still in progress", c.chatroom)
 	}
 
-	guesserMessage := NewGameResponseEvent {
-		Cards: game.cards.whiteCards(),
-		TeamTurn: game.teamTurn,
+	var rematch RematchRequestEvent
+	if len(event.Payload) > 0 {
+		if err := json.Unmarshal(event.Payload, &rematch); err != nil {
+			return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
+		}
 	}
-	guesserEvent, err := packageMessage(EventNewGame, guesserMessage)
+
+	/* Same players, same bots, fresh board. The players are rotated
+	   to build the new game, and put back if it can't be built. */
+	players := maps.Clone(game.players)
+	bots := game.bots
+	type alignment struct {
+		team Team
+		role Role
+	}
+	aligned := make(map[*Client]alignment, len(players))
+	for _, player := range players {
+		aligned[player] = alignment{player.team, player.role}
+	}
+
+	if rematch.RotateTeams {
+		for _, player := range players {
+			player.team = player.team.Change()
+		}
+		bots = bots.rotateTeams()
+	}
+	if rematch.RotateRoles {
+		for _, player := range players {
+			player.role = player.role.Change()
+		}
+		bots = bots.rotateRoles()
+	}
+	newGame, err := m.buildGame(c.chatroom, players, &bots)
 	if err != nil {
-		return err
+		for player, a := range aligned {
+			player.team, player.role = a.team, a.role
+		}
+		return m.refuseGame(c.chatroom, err)
 	}
 
-	/* Send appropriately colored cards based on role. */
-	for _, player := range game.players {
-		if player.role == cluegiver {
-			player.egress <- cluegiverEvent
-		} else {
-			player.egress <- guesserEvent
+	series := m.roomSeries(c.chatroom)
+	if series != nil && series.over {
+		/* Finished series: start another of the same length. */
+		series = NewSeries(series.bestOf)
+		m.setSeries(c.chatroom, series)
+	}
+	if rematch.RotateTeams && series != nil {
+		series.swapTeams()
+	}
+	if rematch.RotateTeams || rematch.RotateRoles {
+		for _, player := range players {
+			updateMsg := PlayerAlignmentResponse {
+				UserName: player.username,
+				TeamColor: player.team,
+				Role: player.role,
+			}
+			m.notifyClients(c.chatroom, EventUpdateParticipant, updateMsg)
 		}
 	}
 
-	return game.botPlay(GiveClueEvent{})
+	m.replaceGame(game, newGame)
+	return newGame.start()
 }
 
+/* Tell the room why makeGame could not make its game. */
+func (m *Manager) refuseGame(room string, err error) error {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		m.notifyClients(room, EventInvalidState, requestErr.Message)
+		return err
+	}
+	m.notifyClients(room, EventInvalidState,
+		"Need one guesser and one cluegiver per team.")
+	return requestError(ErrCodeInvalidState, "invalid game state requested")
+}
+
+/* Leave the game. Aborting a game the client has already left does
+   nothing; leaving one that has ended keeps the player out of its
+   rematch. */
 func AbortGameHandler(event Event, c *Client) error {
-	game, exists := c.manager.games[c.chatroom]
-	if !exists {
-		return fmt.Errorf("Game %v not found", c.chatroom)
+	game := c.manager.game(c.chatroom)
+	if game == nil {
+		return nil
+	}
+	if _, playing := game.players[c.username]; !playing {
+		return nil
 	}
 
 	abortGame := PlayerAlignmentResponse {
@@ -124,11 +301,9 @@ func AbortGameHandler(event Event, c *Client) error {
 		return err
 	}
 
+	/* The last player out ends the game. */
 	game.removePlayer(c.username)
 	if len(game.players) == 0 {
-		if !game.removeGame() {
-			return fmt.Errorf("could not remove game %v", c.chatroom)
-		}
 		return nil
 	}
 
@@ -146,12 +321,19 @@ func AbortGameHandler(event Event, c *Client) error {
 func EndTurnHandler(event Event, c *Client) error {
 	game := c.game
 	if game == nil {
-		return fmt.Errorf("game does not exist")
+		return requestError(ErrCodeNoGame, "game does not exist")
 	}
 	if !game.active {
-		return fmt.Errorf("inactive game")
+		return requestError(ErrCodeNoGame, "inactive game")
 	}
+	game.record(LogEntry{
+		Actor: c.username,
+		Team: c.team,
+		Role: c.role,
+		Action: LogEndTurn,
+	})
 	game.changeTurn()
+	game.recordTurnChange()
 
 	payload := EndTurnEvent {
 		TeamTurn: game.teamTurn,
@@ -166,21 +348,21 @@ func EndTurnHandler(event Event, c *Client) error {
 func GuessEvaluationHandler(event Event, c *Client) error {
 	game := c.game
 	if game == nil {
-		return fmt.Errorf("game does not exist")
+		return requestError(ErrCodeNoGame, "game does not exist")
 	}
 	if !game.active {
-		return fmt.Errorf("inactive game")
+		return requestError(ErrCodeNoGame, "inactive game")
 	}
 	if c.team != game.teamTurn {
-		return errors.New("player team doesn't match team turn")
+		return requestError(ErrCodeNotYourTurn, "player team doesn't match team turn")
 	}
 	if c.role != game.roleTurn {
-		return fmt.Errorf("player role doesn't match role turn")
+		return requestError(ErrCodeNotYourTurn, "player role doesn't match role turn")
 	}
 
 	var guessResponse GuessResponseEvent
 	if err := json.Unmarshal(event.Payload, &guessResponse); err != nil {
-		return fmt.Errorf("bad payload in request: %v", err)
+		return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
 	}
 	guessResponse.TeamColor = c.team
 	if GuessEvaluation(guessResponse, c) {
@@ -193,11 +375,31 @@ func GuessEvaluationHandler(event Event, c *Client) error {
 func GuessEvaluation(guessResponse GuessResponseEvent, c *Client) bool {
 	game := c.game
 	guess := guessResponse.Guess
+	_, end := game.startSpan("GuessEvaluation", attrTeam.String(c.team.String()),
+		attribute.String("guess", guess))
+	defer end(nil)
 	if _, exists := game.cards[guess]; !exists {
 		return false
 	}
 	cardColor := game.cards[guess]
+	teamTurn, roleTurn := game.teamTurn, game.roleTurn
 	guessResponse.Correct = game.evaluateGuess(cardColor)
+	actor := c.username
+	if actor == "" {
+		actor = guessResponse.Guesser
+	}
+	game.record(LogEntry{
+		Actor: actor,
+		Team: c.team,
+		Role: guesser,
+		Action: LogGuess,
+		Detail: guess,
+		Result: cardColor,
+		Correct: guessResponse.Correct,
+	})
+	if game.teamTurn != teamTurn || game.roleTurn != roleTurn {
+		game.recordTurnChange()
+	}
 	guessResponse.GuessRemaining = game.guessRemaining
 	guessResponse.CardColor = cardColor
 	guessResponse.TeamTurn  = game.teamTurn
@@ -213,12 +415,16 @@ func GuessEvaluation(guessResponse GuessResponseEvent, c *Client) bool {
 
 	if cardColor == deathCard {
 		t := c.team.Title()
+		game.winner = c.team.Change()
+		game.cause = OutcomeAssassin
 		game.removeGame(fmt.Sprintf("%v Team uncovers the Black Card. %v Team loses!", t, t))
 		return false
 	}
 
 	t := Team(cardColor)
 	if game.score[t] <= 0  {
+		game.winner = t
+		game.cause = OutcomeAllCards
 		game.removeGame(fmt.Sprintf("%v Team wins!", t.Title()))
 		return false
 	}
@@ -233,10 +439,10 @@ func GuessEvaluation(guessResponse GuessResponseEvent, c *Client) bool {
 func ClueHandler(event Event, c *Client) error {
 	game := c.game
 	if game == nil {
-		return fmt.Errorf("game does not exist")
+		return requestError(ErrCodeNoGame, "game does not exist")
 	}
 	if !game.active {
-		return fmt.Errorf("inactive game")
+		return requestError(ErrCodeNoGame, "inactive game")
 	}
 
 	// if we're here, a clue was given; now it's the guesser's turn
@@ -244,8 +450,20 @@ func ClueHandler(event Event, c *Client) error {
 
 	var clue GiveClueEvent
 	if err := json.Unmarshal(event.Payload, &clue); err != nil {
-		return fmt.Errorf("bad payload in request: %v", err)
-	}
+		return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
+	}
+	actor := c.username
+	if actor == "" {
+		actor = clue.From
+	}
+	game.record(LogEntry{
+		Actor: actor,
+		Team: c.team,
+		Role: cluegiver,
+		Action: LogClue,
+		Detail: clue.Clue,
+		Number: clue.NumCards,
+	})
 	if (clue.NumCards <= 0) {
 		/* TODO: clue.NumCards == -1 if ChatGPT returned something
 		   unparseable or barely parseable. Consider handling this
@@ -267,9 +485,11 @@ func ClueHandler(event Event, c *Client) error {
 }
 
 func ChatRoomHandler(event Event, c *Client) error {
+	m := c.manager
+
 	var changeroom ChangeRoomEvent
 	if err := json.Unmarshal(event.Payload, &changeroom); err != nil {
-		return fmt.Errorf("bad payload in request: %v", err)
+		return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
 	}
 
 	oldroom := c.chatroom
@@ -280,37 +500,62 @@ func ChatRoomHandler(event Event, c *Client) error {
 		return nil
 	}
 
-	// remove client from game, if there is one
-	if c.game != nil {
-		c.game.removePlayer(c.username)
+	if err := m.allowNewRoom(c, newroom); err != nil {
+		return err
 	}
+	/* Before leaving, which may close the old room. */
+	ctx := m.traceContext(c)
 
-	// remove client from old chat room
-	delete(c.manager.chats[oldroom], c.username)
+	// remove client from old chat room and its game, if there
+	// is one, and notify the room that client has left
+	if room := m.room(oldroom); room != nil {
+		m.exitRoom(room, c, event.Payload)
+	}
 
-	// notify old chat room that client has left
-	c.manager.notifyClients(oldroom, EventExitRoom, event.Payload)
+	/* The client enters the new room on that room's goroutine. The
+	   move and the task are published together, so anything queued
+	   for the client afterwards runs in the new room after it. */
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chatroom = newroom
+	m.postToRoom(newroom, func(room *Room) {
+		err := room.handle(ctx, event, func() error {
+			return enterRoom(room, changeroom, c)
+		})
+		if err != nil {
+			c.eventLogger(event).Error().Err(err).Msg("could not enter chat room")
+		}
+	})
+	return nil
+}
+
+/* Runs on the new room's goroutine. */
+func enterRoom(room *Room, changeroom ChangeRoomEvent, c *Client) error {
+	m := c.manager
 
 	// record whether there is a game in progress in the new room
 	changeroom.GameInProgress = false
-	if _, exists:= c.manager.games[newroom]; exists {
-		if len(c.manager.games[newroom].players) > 0 {
+	if game := m.game(room.name); game != nil {
+		if len(game.players) > 0 {
 			changeroom.GameInProgress = true
 		}
 	}
 
 	// notify new room that the client is entering
-	c.manager.notifyClients(newroom, EventEnterRoom, changeroom)
+	m.notifyClients(room.name, EventEnterRoom, changeroom)
 
 	// enter client into new chat room
-	c.chatroom = newroom
-	c.manager.makeChatRoom(newroom)
-	c.manager.chats[newroom][c.username] = c
+	room.clients[c.username] = c
 
-	// send list of current chat room participants to client
-	changeroom.Participants = c.manager.chats[newroom].listClients()
+	// send list of current chat room participants to client,
+	// and the bots of the game in progress
+	changeroom.Participants = room.clients.listClients()
+	if game := m.game(room.name); game != nil {
+		changeroom.Participants = append(changeroom.Participants, game.botParticipants()...)
+	}
 	outgoingEvent, err := packageMessage(EventEnterRoom, changeroom)
-	c.egress <- outgoingEvent
+	outgoingEvent.RequestID = room.request
+	c.send(outgoingEvent)
 	return err
 }
 
@@ -337,7 +582,7 @@ func RoleChangeHandler(event Event, c *Client) error {
 func SendMessage(event Event, c *Client) error {
 	var chatevent SendMessageEvent
 	if err := json.Unmarshal(event.Payload, &chatevent); err != nil {
-		return fmt.Errorf("bad payload in request: %v", err)
+		return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
 	}
 
 	broadMessage := NewMessageEvent {
@@ -352,8 +597,10 @@ func SendMessage(event Event, c *Client) error {
 	return c.manager.notifyClients(c.chatroom, EventNewMessage, broadMessage)
 }
 
+/* Must be called on the room's goroutine. */
 func (m *Manager) notifyClients(room string, messageType string, message any) error {
-	if _, exists := m.chats[room]; !exists {
+	r := m.room(room)
+	if r == nil {
 		return fmt.Errorf("chat room %v does not exist", room)
 	}
 
@@ -361,14 +608,25 @@ func (m *Manager) notifyClients(room string, messageType string, message any) er
 	if err != nil {
 		return err
 	}
+	outgoingEvent.RequestID = r.request
 
-	for _, client := range m.chats[room] {
-		client.egress <- outgoingEvent
+	for _, client := range r.clients {
+		client.send(outgoingEvent)
 	}
 
 	return nil
 }
 
+/* The request being handled for the client, for events sent only to
+   it. Must be called on the goroutine handling the client's events. */
+func (m *Manager) requestOf(c *Client) string {
+	room := m.room(c.room())
+	if room == nil {
+		room = m.room(defaultChatRoom)
+	}
+	return room.request
+}
+
 func packageMessage(messageType string, message any) (Event, error) {
 	data, err := json.Marshal(message)
 	if err != nil {
@@ -382,28 +640,181 @@ func packageMessage(messageType string, message any) (Event, error) {
 	}, nil
 }
 
-func (m *Manager) makeChatRoom(name string) {
+func (m *Manager) makeChatRoom(name string) *Room {
+	m.Lock()
+	defer m.Unlock()
+
+	if room, exists := m.chats[name]; exists {
+		return room
+	}
+	m.chats[name] = newRoom(name)
+	return m.chats[name]
+}
+
+/* Queue a task on the room, opening the room if need be. Both are
+   done under the manager's lock, so the room cannot close between
+   them. */
+func (m *Manager) postToRoom(name string, task func(room *Room)) {
 	m.Lock()
 	defer m.Unlock()
 
-	if _, exists := m.chats[name]; exists {
+	room, exists := m.chats[name]
+	if !exists {
+		room = newRoom(name)
+		m.chats[name] = room
+	}
+	room.post(func() {
+		task(room)
+	})
+}
+
+/* A client may only open new rooms so fast, as each one lives until
+   everyone has left it. */
+func (m *Manager) allowNewRoom(c *Client, name string) error {
+	if m.room(name) != nil {
+		return nil
+	}
+	if ok, wait := m.roomLimiter.allow(c.username); !ok {
+		return requestError(ErrCodeTooManyRooms, "Too many new chat rooms. Try again in %v.",
+			wait.Truncate(time.Second)+time.Second)
+	}
+	return nil
+}
+
+/* Queue a task on the named room if it is open. A room looked up may
+   close before the task is queued, so a closed one is looked up again. */
+func (m *Manager) postToOpenRoom(name string, task func(room *Room)) bool {
+	for {
+		room := m.room(name)
+		if room == nil {
+			return false
+		}
+		queued := room.post(func() {
+			task(room)
+		})
+		if queued {
+			return true
+		}
+	}
+}
+
+/* Close the room once nobody is in it and nothing is waiting to run
+   on it, so that rooms don't pile up. Its queue is closed with it, so
+   tasks for it that were not queued in time go to the room that takes
+   its place. Runs on the room's goroutine. */
+func (m *Manager) closeRoomIfEmpty(room *Room) {
+	if room.name == defaultChatRoom || len(room.clients) > 0 {
 		return
 	}
-	m.chats[name] = make(ClientList)
+	m.Lock()
+	closed := m.chats[room.name] == room && m.games[room.name] == nil && room.closeIfIdle()
+	if closed {
+		delete(m.chats, room.name)
+		delete(m.series, room.name)
+	}
+	m.Unlock()
+
+	if closed {
+		m.releaseRoom(room.name)
+		log.Debug().Str("room", room.name).Msg("closed empty chat room")
+	}
+}
+
+/* The maps below are shared by all rooms, so they are only touched
+   under the manager's lock. What they point to belongs to a room and
+   is only changed on that room's goroutine. */
+
+func (m *Manager) room(name string) *Room {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.chats[name]
+}
+
+func (m *Manager) game(room string) *Game {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.games[room]
+}
+
+/* Delete the game unless the room has started another one since.
+   A game deleted while still being played no longer counts as active. */
+func (m *Manager) deleteGame(game *Game) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.games[game.name] != game {
+		return
+	}
+	delete(m.games, game.name)
+	if game.active {
+		game.active = false
+		m.metrics.activeGames.Dec()
+	}
+}
+
+func (m *Manager) roomSeries(room string) *Series {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.series[room]
+}
+
+/* A nil series ends the room's series. */
+func (m *Manager) setSeries(room string, series *Series) {
+	m.Lock()
+	defer m.Unlock()
+
+	if series == nil {
+		delete(m.series, room)
+		return
+	}
+	m.series[room] = series
 }
 
 func (m *Manager) makeGame(name string, players ClientList, bots *BotActions) (*Game, error) {
 	m.Lock()
 	defer m.Unlock()
 
-	if game, exists := m.games[name]; exists {
-		return game, nil
+	old := m.games[name]
+	if old != nil && old.active {
+		return nil, requestError(ErrCodeGameInProgress, "game %v is still in progress", name)
 	}
+	game, err := m.buildGame(name, players, bots)
+	if err != nil {
+		return nil, err
+	}
+	/* A finished game stays until its room starts another. */
+	if old != nil {
+		for _, player := range old.players {
+			if player.game == old {
+				player.game = nil
+			}
+		}
+		delete(m.games, name)
+	}
+	m.addGame(game)
+	return game, nil
+}
+
+/* A new game for the players and bots as they are now, checked but
+   not yet the room's game. */
+func (m *Manager) buildGame(name string, players ClientList, bots *BotActions) (*Game, error) {
 	actions := getActions(players, bots)
 	if !actions.validate() {
 		return nil, fmt.Errorf("invalid actions")
 	}
+	if bots != nil {
+		seated, err := bots.withSeats(botCatalog)
+		if err != nil {
+			return nil, err
+		}
+		bots = &seated
+	}
+	id := uuid.NewString()
 	game := &Game {
+		id: id,
 		name: name,
 		players: maps.Clone(players),
 		cards: getCards(),
@@ -416,71 +827,221 @@ func (m *Manager) makeGame(name string, players ClientList, bots *BotActions) (*
 		},
 		manager: m,
 		active: true,
+		log: log.With().Str("game", id).Str("room", name).Logger(),
+	}
+	if bots != nil {
+		game.bots = *bots
 	}
 	if game.actions.playerCount(red) == 0 {
 		game.teamTurn = blue
 	}
-	game.makeBot(bots)
-	m.games[name] = game
-	
-	for _, player := range players {
+	game.record(LogEntry{
+		Actor: serverActor,
+		Team: game.teamTurn,
+		Role: game.roleTurn,
+		Action: LogStart,
+	})
+	if err := game.makeBot(bots); err != nil {
+		return nil, err
+	}
+	return game, nil
+}
+
+/* Make the game its room's game. Must hold the manager's lock. */
+func (m *Manager) addGame(game *Game) {
+	m.games[game.name] = game
+	m.metrics.activeGames.Inc()
+	game.log.Info().Int("players", len(game.players)).Msg("game started")
+
+	for _, player := range game.players {
 		player.game = game
 	}
+}
 
-	return game, nil
+/* Replace a finished game with a new one for the same room. */
+func (m *Manager) replaceGame(old *Game, game *Game) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, player := range old.players {
+		player.game = nil
+	}
+	if m.games[old.name] == old {
+		delete(m.games, old.name)
+	}
+	m.addGame(game)
 }
 
 /* Return true if game was deleted. */
 func (m *Manager) removeGame(room string, message ...string) bool {
-	m.Lock()
-	defer m.Unlock()
-	
-	game := m.games[room]
+	game := m.game(room)
 	if game != nil {
 		if game.active {
 			gameOverMsg := GameOverEvent{
+				GameID: game.id,
 				Cards: game.cards.getUnrevealedCards(),
 			}
 			if len(message) > 0 {
 				gameOverMsg.Message = message[0]
 			}
+			game.record(LogEntry{
+				Actor: serverActor,
+				Team: game.winner,
+				Action: LogGameOver,
+				Result: gameOverMsg.Message,
+			})
+			gameOverMsg.Log = game.history
+			if game.usage.Calls > 0 {
+				usage := game.usage
+				gameOverMsg.Usage = &usage
+			}
+			gameOverMsg.KeyCard = game.cards.keyCard()
+			m.archiveGame(game)
+			if series := m.roomSeries(room); series != nil {
+				if game.winner != "" {
+					series.record(game.winner)
+				}
+				gameOverMsg.Series = series.score()
+			}
 			m.notifyClients(room, EventGameOver, gameOverMsg)
+			game.log.Info().Str("cause", game.cause).Str("winner", string(game.winner)).
+				Msg("game over")
 			game.active = false
 			game.bot = nil
+			m.metrics.activeGames.Dec()
 		}
 		if len(game.players) == 0 {
-			delete(m.games, room)
+			m.deleteGame(game)
 			return true
 		}
 	}
 	return false
 }
 
+/* Handle an event from a client, and tell the client how it went.
+   Events for a room owned by another instance are answered there. */
 func (m *Manager) routeEvent(event Event, c *Client) error {
+	name := c.room()
+	attrs := []attribute.KeyValue{
+		attrEvent.String(event.Type),
+		attrUser.String(c.username),
+		attrRoom.String(name),
+		attrRequest.String(event.RequestID),
+	}
+	if game := m.game(name); game != nil {
+		attrs = append(attrs, attrGame.String(game.id))
+	}
+	ctx, span := startSpan(context.Background(), "routeEvent", attrs...)
+	err := m.dispatchEvent(ctx, event, c)
+	endSpan(span, err)
+	return err
+}
+
+/* Run the handler on the goroutine of the client's room. Clients
+   that have not entered a room yet are served by the lobby. */
+func (m *Manager) dispatchEvent(ctx context.Context, event Event, c *Client) error {
+	/* Unknown events are throttled too, before they are answered. */
+	if !m.allowEvent(event, c) {
+		return nil
+	}
 	if handler, ok := m.handlers[event.Type]; ok {
-		if err := handler(event, c); err != nil {
-			return err
+		if event.Type == EventEnterRoom {
+			if moved, err := m.moveClient(ctx, event, c); moved {
+				c.respond(event, err)
+				return err
+			}
+		}
+		/* Events for rooms owned by another instance go there. */
+		if name := c.room(); name != "" {
+			if owner := m.ownerOf(name); owner != m.id {
+				err := m.forward(owner, Envelope{
+					Kind:  EnvelopeEvent,
+					Room:  name,
+					User:  c.username,
+					Event: event,
+				})
+				if err != nil {
+					c.respond(event, err)
+				}
+				return err
+			}
+		}
+
+		/* The room may close before the event is queued. */
+		for {
+			room := m.room(c.room())
+			if room == nil {
+				room = m.room(defaultChatRoom)
+			}
+			err := room.do(func() error {
+				return room.handle(ctx, event, func() error {
+					err := handler(event, c)
+					c.respond(event, err)
+					return err
+				})
+			})
+			if err != errQueueClosed {
+				return err
+			}
 		}
-		return nil
 	} else {
-		return errors.New("there is no such event type")
+		err := requestError(ErrCodeUnknownEvent, "there is no such event type: %v", event.Type)
+		c.respond(event, err)
+		return err
 	}
 }
 
 func (m *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
+	if m.closing.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	addr := clientAddr(r)
+	if m.bans.banned(addr) {
+		http.Error(w, "Too many messages from your address. Try again later.", http.StatusForbidden)
+		return
+	}
+
 	otp := r.URL.Query().Get("otp")
 	if otp == "" {
+		m.metrics.otpsRejected.WithLabelValues("missing").Inc()
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	username := m.otps.VerifyOTP(otp)
+	username, err := m.otps.VerifyOTP(otp)
+	if err != nil {
+		log.Error().Err(err).Msg("could not verify otp")
+		m.metrics.otpsRejected.WithLabelValues("error").Inc()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	if username == "" {
+		m.metrics.otpsRejected.WithLabelValues("invalid").Inc()
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	log.Info().Msg("new connection")
+	/* The user may have logged in on another instance, which holds
+	   the claim on the name until it is handed over here. A session
+	   they have open already, there or here, ends. */
+	m.endSession(username)
+	if previous, err := m.broker.Take(userClaim(username)); err != nil {
+		log.Error().Err(err).Str("user", username).Msg("could not take over user name")
+	} else {
+		if previous != "" && previous != m.id {
+			err := m.forward(previous, Envelope{Kind: EnvelopeReplaced, User: username})
+			if err != nil {
+				log.Error().Err(err).Str("user", username).Msg("could not end session at another instance")
+			}
+		}
+		if _, err := m.broker.Claim(userClaim(username), m.id, ownershipTTL); err != nil {
+			log.Error().Err(err).Str("user", username).Msg("could not claim user name")
+		}
+	}
+
+	log.Info().Str("user", username).Str("addr", addr).Msg("new connection")
 
 	// upgrade regular http connection into websocket
 	conn, err := websocketUpgrader.Upgrade(w, r, nil)
@@ -490,6 +1051,11 @@ func (m *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := NewClient(username, conn, m)
+	client.addr = addr
+	/* Only the account holder can log in with a registered name. */
+	if _, err := m.accounts.GetAccount(username); err == nil {
+		client.registered = true
+	}
 
 	m.addClient(client)
 
@@ -498,50 +1064,115 @@ func (m *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
 	go client.writeMessages()
 }
 
-func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
-	type userLoginRequest struct {
-		Username string `json:"username"`
+/* User names must be non-empty, without whitespace, and not taken
+   by the bots or the server in game logs. */
+func validUsername(name string) error {
+	if name == "" {
+		return errors.New("User name must not be empty")
+	}
+	if regexp.MustCompile(`\s`).MatchString(name) {
+		return errors.New("User name must not contain whitespace")
+	}
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, strings.ToLower(botName)) || lower == serverActor {
+		return fmt.Errorf("User name %v is reserved", name)
 	}
+	return nil
+}
 
+func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		OTP string `json:"otp"`
+		OTP        string `json:"otp"`
+		Registered bool   `json:"registered"`
 	}
 
 	var (
-		req  userLoginRequest
+		req  credentials
 		resp response
 	)
 
+	if m.closing.Load() {
+		http.Error(w, "Server is shutting down. Try again shortly.", http.StatusServiceUnavailable)
+		return
+	}
+
+	addr := clientAddr(r)
+	if m.bans.banned(addr) {
+		http.Error(w, "Too many messages from your address. Try again later.", http.StatusForbidden)
+		return
+	}
+	if ok, wait := m.loginLimiter.allow(addr); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many logins. Try again in a few seconds.", http.StatusTooManyRequests)
+		return
+	}
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Check for valid username (non-empty, no whitespace)
-	if req.Username == "" {
-		http.Error(w, "User name must not be empty", http.StatusBadRequest)
+	if err := validUsername(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if regexp.MustCompile(`\s`).MatchString(req.Username) {
-		http.Error(w, "User name must not contain whitespace", http.StatusBadRequest)
+
+	// Registered names need their password; guests give none
+	account, err := m.accounts.GetAccount(req.Username)
+	switch {
+	case errors.Is(err, ErrAccountNotFound):
+		if req.Password != "" {
+			http.Error(w, "There is no account named \"" + req.Username + "\". Register first, or log in as a guest without a password.",
+				http.StatusUnauthorized)
+			return
+		}
+	case err != nil:
+		log.Error().Err(err).Str("user", req.Username).Msg("could not look up account")
+		http.Error(w, "Could not log in. Try again shortly.", http.StatusServiceUnavailable)
 		return
+	case req.Password == "":
+		http.Error(w, "User name \"" + req.Username + "\" is registered. Enter its password, or choose a different username.",
+			http.StatusUnauthorized)
+		return
+	case !account.checkPassword(req.Password):
+		http.Error(w, "Wrong password for \"" + req.Username + "\".", http.StatusUnauthorized)
+		return
+	default:
+		resp.Registered = true
 	}
 
-	// Enforce unique usernames
-	if _, exists := m.clients[req.Username]; exists {
+	// Enforce unique usernames, on every instance
+	m.RLock()
+	_, exists := m.clients[req.Username]
+	m.RUnlock()
+	if !exists {
+		owner, err := m.broker.Claim(userClaim(req.Username), m.id, ownershipTTL)
+		if err != nil {
+			log.Error().Err(err).Str("user", req.Username).Msg("could not claim user name")
+		} else if owner != m.id {
+			exists = true
+		}
+	}
+	if exists {
 		// someone with this username is already logged in
 		http.Error(w, 
 			"User name \"" + req.Username + "\" is already logged in. Choose a different username.",
 			http.StatusConflict)
 		return
 	} else {
-		otp := m.otps.NewOTP(req.Username)
+		otp, err := m.otps.NewOTP(req.Username)
+		if err != nil {
+			log.Error().Err(err).Str("user", req.Username).Msg("could not store otp")
+			http.Error(w, "Could not log in. Try again shortly.", http.StatusServiceUnavailable)
+			return
+		}
 		resp.OTP = otp.Key
+		m.metrics.otpsIssued.Inc()
 	}
 
 	data, err := json.Marshal(resp)
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("could not marshal login response")
 		return
 	}
 
@@ -558,22 +1189,66 @@ func (m *Manager) addClient(client *Client) {
 
 func (m *Manager) removeClient(client *Client) {
 	m.Lock()
-	defer m.Unlock()
+	current, exists := m.clients[client.username]
+	if exists && current == client {
+		delete(m.clients, client.username)
+	}
+	m.Unlock()
+
+	if exists && current == client {
+		if client.connection != nil {
+			client.connection.Close()
+		}
+		m.leaveRoom(client)
+		m.broker.Release(userClaim(client.username), m.id)
+	}
+}
+
+/* Take the client out of its room and game on the room's goroutine,
+   following the client if it is on its way to another room. */
+func (m *Manager) leaveRoom(client *Client) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
 
-	room := client.chatroom
-	if _, exists := m.games[room]; exists {
-		m.games[room].removePlayer(client.username)
+	client.removed = true
+	if client.chatroom == "" {
+		return
+	}
+	// notify chat room of client departure
+	exit := ChangeRoomEvent {
+		UserName: client.username,
 	}
-	if _, exists := m.chats[room]; exists {
-		delete(m.chats[room], client.username)
+
+	if owner := m.ownerOf(client.chatroom); owner != m.id {
+		payload, _ := json.Marshal(exit)
+		m.forward(owner, Envelope{
+			Kind:       EnvelopeLeave,
+			Room:       client.chatroom,
+			User:       client.username,
+			Disconnect: true,
+			Event:      Event{Type: EventExitRoom, Payload: payload},
+		})
+		return
 	}
-	if _, exists := m.clients[client.username]; exists {
-		client.connection.Close()
-		// notify chat room of client departure
-		exit := ChangeRoomEvent {
-			UserName: client.username,
+
+	m.postToOpenRoom(client.chatroom, func(room *Room) {
+		if client.room() != room.name {
+			m.leaveRoom(client)
+			return
 		}
-		m.notifyClients(room, EventExitRoom, exit)
-		delete(m.clients, client.username)
+		m.exitRoom(room, client, exit)
+	})
+}
+
+/* Take the client out of the room and its game, and tell the room.
+   Runs on the room's goroutine. */
+func (m *Manager) exitRoom(room *Room, c *Client, payload any) {
+	if game := m.game(room.name); game != nil {
+		game.removePlayer(c.username)
 	}
-}
\ No newline at end of file
+	delete(room.clients, c.username)
+	m.endSeriesIfEmpty(room.name)
+
+	m.notifyClients(room.name, EventExitRoom, payload)
+	m.closeRoomIfEmpty(room)
+}
@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	openai "github.com/sashabaranov/go-openai"
 )
 
 func setupManager(t *testing.T, ws *websocket.Conn) *Manager {
@@ -132,6 +138,34 @@ func TestMakeGame(t *testing.T) {
 	}
 }
 
+/* A new game is refused while one is played, and the series carries
+   on; once the game is over, the room gets a new one. */
+func TestNewGameInProgress(t *testing.T) {
+	manager := setupGame(t, nil, nil)
+	client1 := manager.clients["testClient1"]
+	client2 := manager.clients["testClient2"]
+	manager.makeChatRoom("test").clients = ClientList{"testClient1": client1, "testClient2": client2}
+	manager.series["test"] = NewSeries(3)
+	game := manager.games["test"]
+
+	newGame := Event{Type: EventNewGame, Payload: json.RawMessage(`{}`)}
+	if err := NewGameHandler(newGame, client1); errorCode(err) != ErrCodeGameInProgress {
+		t.Errorf("new game during a game: %v", err)
+	}
+	if manager.games["test"] != game || manager.series["test"] == nil {
+		t.Error("game or series replaced during a game")
+	}
+
+	game.removeGame("Red Team wins!")
+	if err := NewGameHandler(newGame, client1); err != nil {
+		t.Fatalf("new game after a game: %v", err)
+	}
+	next := manager.games["test"]
+	if next == game || !next.active || client1.game != next || manager.series["test"] != nil {
+		t.Errorf("new game %p (was %p), active %v, series %v", next, game, next.active, manager.series["test"])
+	}
+}
+
 func TestGuessEvaluationHandler(t *testing.T) {
 	s, ws := setupWSTestServer(t)
 	defer s.Close()
@@ -196,4 +230,380 @@ func TestGuessEvaluationHandler(t *testing.T) {
 	if !reflect.DeepEqual(gre, expect) {
 		t.Errorf("Expected: %#v\nGot: %#v", expect, gre)
 	}
-}
\ No newline at end of file
+}
+
+func drainEgress(t *testing.T, clients ...*Client) {
+	t.Helper()
+
+	for _, c := range clients {
+		go func(c *Client) {
+			for range c.egress {
+			}
+		}(c)
+	}
+}
+
+func TestSeriesRecord(t *testing.T) {
+	series := NewSeries(3)
+	if series.record(red) {
+		t.Error("series decided after one game")
+	}
+	if series.record(blue) {
+		t.Error("series decided after two split games")
+	}
+	if !series.record(blue) {
+		t.Error("series not decided after three games")
+	}
+	score := series.score()
+	if score.Winner != blue || score.Wins[blue] != 2 || score.Wins[red] != 1 {
+		t.Errorf("unexpected series score: %#v", score)
+	}
+
+	if NewSeries(4).bestOf != 5 {
+		t.Error("best of an even number should round up to an odd number")
+	}
+}
+
+func TestRematch(t *testing.T) {
+	manager := setupGame(t, nil, nil)
+	client1 := manager.clients["testClient1"]
+	client2 := manager.clients["testClient2"]
+	drainEgress(t, client1, client2)
+
+	manager.series["test"] = NewSeries(3)
+	oldGame := manager.games["test"]
+	oldGame.winner = red
+	oldGame.removeGame("Red Team wins!")
+	if oldGame.active {
+		t.Fatal("game still active after removeGame")
+	}
+	if manager.series["test"].wins[red] != 1 {
+		t.Fatalf("series did not record the winner: %v", manager.series["test"].wins)
+	}
+
+	payload, _ := json.Marshal(RematchRequestEvent{RotateTeams: true})
+	if err := RematchHandler(Event{Type: EventRematch, Payload: payload}, client1); err != nil {
+		t.Fatalf("rematch failed: %v", err)
+	}
+
+	game := manager.games["test"]
+	if game == nil || game == oldGame {
+		t.Fatal("rematch did not create a new game")
+	}
+	if !game.active {
+		t.Error("rematch game is not active")
+	}
+	if len(game.players) != 2 || client1.game != game || client2.game != game {
+		t.Error("rematch game does not have the same players")
+	}
+	if client1.team != blue || client2.team != blue {
+		t.Errorf("teams not rotated: %v, %v", client1.team, client2.team)
+	}
+	if client2.role != cluegiver {
+		t.Errorf("role should not rotate: %v", client2.role)
+	}
+	if game.teamTurn != blue {
+		t.Errorf("blue-only game should start with blue, got %v", game.teamTurn)
+	}
+	/* Series score follows the players to their new team. */
+	if manager.series["test"].wins[blue] != 1 {
+		t.Errorf("series score not rotated: %v", manager.series["test"].wins)
+	}
+}
+
+/* A rematch that can't start leaves the players and the finished game
+   as they were. */
+func TestRematchRefused(t *testing.T) {
+	manager := setupGame(t, nil, &BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Blue: true},
+	})
+	manager.makeChatRoom("test")
+	client1 := manager.clients["testClient1"]
+	client2 := manager.clients["testClient2"]
+	drainEgress(t, client1, client2)
+	oldGame := manager.games["test"]
+	oldGame.removeGame("Red Team wins!")
+
+	/* The bots have used up their budget. */
+	manager.usage.setBudgets(Budgets{Daily: 1})
+	manager.usage.record("test", openai.Usage{PromptTokens: 10}, time.Now())
+	payload, _ := json.Marshal(RematchRequestEvent{RotateTeams: true, RotateRoles: true})
+	err := RematchHandler(Event{Type: EventRematch, Payload: payload}, client1)
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) || requestErr.Code != ErrCodeBudgetExhausted {
+		t.Errorf("rematch over budget: got %v", err)
+	}
+	if manager.games["test"] != oldGame || client1.game != oldGame {
+		t.Error("finished game retired")
+	}
+	if client1.team != red || client1.role != guesser || client2.team != red || client2.role != cluegiver {
+		t.Errorf("players rotated: %v %v, %v %v", client1.team, client1.role, client2.team, client2.role)
+	}
+}
+
+func TestReplayHandler(t *testing.T) {
+	manager := setupDeck(t, nil, nil)
+	game := manager.games["test"]
+	game.roleTurn = guesser
+	game.guessRemaining = totalNumCards
+	client1 := manager.clients["testClient1"]
+	drainEgress(t, client1, manager.clients["testClient2"])
+
+	guess, _ := json.Marshal(GuessEvent{Guess: "redword", Guesser: "testClient1"})
+	GuessEvaluationHandler(Event{Type: EventMakeGuess, Payload: guess}, client1)
+	guess, _ = json.Marshal(GuessEvent{Guess: "deathword", Guesser: "testClient1"})
+	GuessEvaluationHandler(Event{Type: EventMakeGuess, Payload: guess}, client1)
+	if game.active {
+		t.Fatal("game should be over")
+	}
+
+	w := httptest.NewRecorder()
+	manager.replayHandler(w, httptest.NewRequest(http.MethodGet, "/replay?id="+game.id, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var replay GameRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &replay); err != nil {
+		t.Fatalf("could not unmarshal replay: %v", err)
+	}
+	if replay.ID != game.id || replay.Room != "test" {
+		t.Errorf("wrong game: %v in %v", replay.ID, replay.Room)
+	}
+	if slices.Compare(replay.Board, []string{"blueword", "deathword", "neutralword", "redword"}) != 0 {
+		t.Errorf("unexpected board: %v", replay.Board)
+	}
+	if replay.KeyCard["redword"] != "red" || replay.KeyCard["deathword"] != deathCard {
+		t.Errorf("unexpected key card: %v", replay.KeyCard)
+	}
+	if replay.Winner != blue {
+		t.Errorf("expected blue to win, got %v", replay.Winner)
+	}
+	var guesses []LogEntry
+	for _, step := range replay.Steps {
+		if step.Action == LogGuess {
+			guesses = append(guesses, step)
+		}
+	}
+	if len(guesses) != 2 || guesses[0].Score[red] != 8 || guesses[1].Result != deathCard {
+		t.Errorf("unexpected guesses: %#v", guesses)
+	}
+
+	/* A new game in the same room gets a new ID. */
+	manager.games["test"].players = ClientList{}
+	manager.removeGame("test")
+	manager.makeGame("test", ClientList{"testClient1": client1, "testClient2": manager.clients["testClient2"]}, nil)
+	if manager.games["test"].id == game.id {
+		t.Error("game IDs must not be reused")
+	}
+
+	w = httptest.NewRecorder()
+	manager.replayHandler(w, httptest.NewRequest(http.MethodGet, "/replay?id=nonesuch", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %v", w.Code)
+	}
+}
+
+/* Many clients moving between rooms, chatting and starting games at
+   the same time. Run with -race. */
+func TestConcurrentClients(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+
+	/* Like serveWS, without the one-time password. */
+	connect := func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(r.URL.Query().Get("name"), conn, manager)
+		manager.addClient(client)
+		go client.readMessages()
+		go client.writeMessages()
+	}
+	s := httptest.NewServer(http.HandlerFunc(connect))
+	defer s.Close()
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	const numClients = 24
+	rooms := []string{"race0", "race1", "race2"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("player%d", i)
+			ws, _, err := websocket.DefaultDialer.Dial(u+"?name="+name, nil)
+			if err != nil {
+				t.Errorf("%v could not connect: %v", name, err)
+				return
+			}
+			defer ws.Close()
+			go func() {
+				for {
+					if _, _, err := ws.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			send := func(eventType string, payload any) {
+				data, _ := json.Marshal(payload)
+				msg, _ := json.Marshal(Event{Type: eventType, Payload: data})
+				if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+					t.Errorf("%v could not send %v: %v", name, eventType, err)
+				}
+			}
+
+			send(EventEnterRoom, ChangeRoomEvent{UserName: name, RoomName: rooms[i%len(rooms)]})
+			if i%2 == 1 {
+				send(EventChangeTeam, struct{}{})
+			}
+			if i%4 < 2 {
+				send(EventChangeRole, struct{}{})
+			}
+			for j := 0; j < 3; j++ {
+				send(EventSendMessage, SendMessageEvent{Message: "hello", From: name})
+			}
+			send(EventNewGame, NewGameRequestEvent{})
+			send(EventGiveClue, map[string]string{"clue": "race", "numCards": "1"})
+			send(EventMakeGuess, GuessEvent{Guess: "nonesuch", Guesser: name})
+			send(EventEndTurn, struct{}{})
+			if i%3 == 0 {
+				send(EventEnterRoom, ChangeRoomEvent{UserName: name, RoomName: rooms[(i+1)%len(rooms)]})
+			}
+			send(EventSendMessage, SendMessageEvent{Message: "bye", From: name})
+			send(EventAbortGame, struct{}{})
+			send(EventRematch, struct{}{})
+		}(i)
+	}
+	wg.Wait()
+
+	/* Every client disconnected, so every room must empty out. */
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		manager.RLock()
+		remaining := len(manager.clients)
+		manager.RUnlock()
+		for _, name := range rooms {
+			room := manager.room(name)
+			if room == nil {
+				continue
+			}
+			room.do(func() error {
+				remaining += len(room.clients)
+				return nil
+			})
+		}
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v clients left behind", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	manager := setupGame(t, nil, nil)
+	client1 := manager.clients["testClient1"]
+	client2 := manager.clients["testClient2"]
+	room := manager.makeChatRoom("test")
+	room.clients["testClient1"] = client1
+	room.clients["testClient2"] = client2
+	game := manager.games["test"]
+
+	/* A bot call in flight finishes during the wait. */
+	manager.botCalls.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		manager.botCalls.Add(-1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	manager.Shutdown(ctx)
+
+	if manager.botCalls.Load() != 0 {
+		t.Error("shutdown did not wait for bot calls")
+	}
+	if manager.ctx.Err() == nil {
+		t.Error("manager context not cancelled")
+	}
+
+	var types []string
+	for len(client1.egress) > 0 {
+		types = append(types, (<-client1.egress).Type)
+	}
+	if len(types) < 2 || types[0] != EventServerShutdown || types[len(types)-1] != EventGameOver {
+		t.Errorf("unexpected events at shutdown: %v", types)
+	}
+
+	record, err := manager.store.Get(game.id)
+	if err != nil {
+		t.Fatalf("game in progress not saved: %v", err)
+	}
+	if record.Cause != OutcomeInterrupted {
+		t.Errorf("expected cause %v, got %v", OutcomeInterrupted, record.Cause)
+	}
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"username": "late"}`)
+	manager.loginHandler(w, httptest.NewRequest(http.MethodPost, "/login", body))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 after shutdown, got %v", w.Code)
+	}
+}
+
+/* Rooms close once everyone has left, and each client may only open
+   so many. */
+func TestRoomLifetime(t *testing.T) {
+	manager := NewManager(context.Background())
+	manager.roomLimiter = newRateLimiter(RateLimit{Rate: 0.001, Burst: 2})
+	alice := NewClient("alice", nil, manager)
+	manager.addClient(alice)
+	enter := func(name string) error {
+		payload, _ := json.Marshal(ChangeRoomEvent{RoomName: name})
+		return manager.routeEvent(Event{Type: EventEnterRoom, Payload: payload}, alice)
+	}
+
+	for _, name := range []string{"den", "attic"} {
+		if err := enter(name); err != nil {
+			t.Fatalf("enter %v: %v", name, err)
+		}
+	}
+	if manager.room("den") != nil || manager.room("attic") == nil {
+		t.Error("empty room left open, or occupied room closed")
+	}
+
+	var requestErr *RequestError
+	if err := enter("cellar"); !errors.As(err, &requestErr) || requestErr.Code != ErrCodeTooManyRooms {
+		t.Errorf("new room over the limit: got %v", err)
+	}
+	if alice.room() != "attic" || manager.room("cellar") != nil {
+		t.Errorf("refused move: in %v", alice.room())
+	}
+	/* Rooms that are open already don't count. */
+	attic := manager.room("attic")
+	if err := enter(defaultChatRoom); err != nil {
+		t.Errorf("enter the lobby: %v", err)
+	}
+	manager.room(defaultChatRoom).do(func() error { return nil })
+	if manager.room("attic") != nil {
+		t.Error("attic still open")
+	}
+
+	/* Those still holding the closed room find it closed. */
+	if err := attic.do(func() error { return nil }); err != errQueueClosed {
+		t.Errorf("task on a closed room: %v", err)
+	}
+	start := time.Now()
+	if _, busy := queryRooms([]*Room{attic}, time.Minute, func(room *Room) (string, bool) {
+		return room.name, true
+	}); len(busy) != 0 || time.Since(start) > time.Second {
+		t.Errorf("query of a closed room: busy %v after %v", busy, time.Since(start))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+/* Prometheus metrics for one manager. Each manager has its own
+   registry, so tests can run several side by side. Values that
+   are already kept elsewhere are read when scraped. */
+type metrics struct {
+	registry *prometheus.Registry
+
+	events       *prometheus.CounterVec
+	eventErrors  *prometheus.CounterVec
+	otpsIssued   prometheus.Counter
+	otpsRejected *prometheus.CounterVec
+	activeGames  prometheus.Gauge
+	gameOutcomes *prometheus.CounterVec
+
+	llmLatency *prometheus.HistogramVec
+	llmErrors  *prometheus.CounterVec
+	llmTokens  *prometheus.CounterVec
+}
+
+const metricsNamespace = "garbanzo"
+
+func newMetrics(m *Manager) *metrics {
+	mt := &metrics{
+		registry: prometheus.NewRegistry(),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_handled_total",
+			Help:      "Events from clients handled by this instance, by type.",
+		}, []string{"type"}),
+		eventErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_errors_total",
+			Help:      "Events from clients that failed, by type and error code.",
+		}, []string{"type", "code"}),
+		otpsIssued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "otps_issued_total",
+			Help:      "One-time passwords issued at login.",
+		}),
+		otpsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "otps_rejected_total",
+			Help:      "Websocket connections refused, by reason: missing, invalid or error.",
+		}, []string{"reason"}),
+		activeGames: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_games",
+			Help:      "Games in progress in rooms owned by this instance.",
+		}),
+		gameOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "games_finished_total",
+			Help:      "Games finished, by how they ended.",
+		}, []string{"cause"}),
+		llmLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "llm_request_duration_seconds",
+			Help:      "Time taken by calls to the language model, by model.",
+			Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+		}, []string{"model"}),
+		llmErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "llm_request_errors_total",
+			Help:      "Failed calls to the language model, by model.",
+		}, []string{"model"}),
+		llmTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "llm_tokens_total",
+			Help:      "Tokens used by calls to the language model, by model and kind: prompt or completion.",
+		}, []string{"model", "kind"}),
+	}
+
+	gauge := func(name string, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, value)
+	}
+	counter := func(name string, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, value)
+	}
+
+	mt.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		mt.events,
+		mt.eventErrors,
+		mt.otpsIssued,
+		mt.otpsRejected,
+		mt.activeGames,
+		mt.gameOutcomes,
+		mt.llmLatency,
+		mt.llmErrors,
+		mt.llmTokens,
+		gauge("connected_clients", "Clients connected to this instance.", func() float64 {
+			m.RLock()
+			defer m.RUnlock()
+			return float64(len(m.clients))
+		}),
+		gauge("rooms", "Chat rooms on this instance.", func() float64 {
+			m.RLock()
+			defer m.RUnlock()
+			return float64(len(m.chats))
+		}),
+		gauge("outbound_queue_depth", "Events waiting to be written to clients, over all clients.", m.egressDepth),
+		gauge("bot_calls_in_flight", "Calls to the language model waiting for an answer.", func() float64 {
+			return float64(m.botCalls.Load())
+		}),
+		counter("dropped_messages_total", "Events dropped because a client's outbound queue was full.", func() float64 {
+			return float64(m.droppedMessages.Load())
+		}),
+		counter("evicted_clients_total", "Clients disconnected for not keeping up.", func() float64 {
+			return float64(m.evictedClients.Load())
+		}),
+		counter("throttled_events_total", "Events dropped for exceeding their rate limits.", func() float64 {
+			return float64(m.throttledEvents.Load())
+		}),
+		counter("banned_clients_total", "Clients banned for flooding.", func() float64 {
+			return float64(m.bannedClients.Load())
+		}),
+	)
+	return mt
+}
+
+/* Events queued for all clients of this instance. */
+func (m *Manager) egressDepth() float64 {
+	m.RLock()
+	defer m.RUnlock()
+
+	depth := 0
+	for _, c := range m.clients {
+		depth += len(c.egress)
+	}
+	return float64(depth)
+}
+
+/* Count an event once it is handled. Unknown types are counted
+   together, so clients can't make up new series. */
+func (mt *metrics) eventHandled(m *Manager, eventType string, err error) {
+	if _, known := m.handlers[eventType]; !known {
+		eventType = unknownEventType
+	}
+	mt.events.WithLabelValues(eventType).Inc()
+	if err != nil {
+		mt.eventErrors.WithLabelValues(eventType, errorCode(err)).Inc()
+	}
+}
+
+func (mt *metrics) llmCall(model string, took time.Duration, resp openai.ChatCompletionResponse, err error) {
+	mt.llmLatency.WithLabelValues(model).Observe(took.Seconds())
+	if err != nil {
+		mt.llmErrors.WithLabelValues(model).Inc()
+		return
+	}
+	mt.llmTokens.WithLabelValues(model, "prompt").Add(float64(resp.Usage.PromptTokens))
+	mt.llmTokens.WithLabelValues(model, "completion").Add(float64(resp.Usage.CompletionTokens))
+}
+
+/* Serve the metrics in the Prometheus text format: /metrics */
+func (m *Manager) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.metrics.registry, promhttp.HandlerOpts{})
+}
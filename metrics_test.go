@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func scrapeMetrics(t *testing.T, manager *Manager) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	manager.metricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics: got %v", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	manager := setupDeck(t, nil, nil)
+	manager.makeChatRoom("test")
+	unlimitedLogins(manager)
+	client := manager.clients["testClient1"]
+	game := manager.games["test"]
+	game.roleTurn = guesser
+
+	manager.routeEvent(Event{Type: "nonesuch"}, client)
+	manager.routeEvent(Event{Type: EventSendMessage, Payload: json.RawMessage(`"hello"`)}, client)
+	guess, _ := json.Marshal(GuessEvent{Guess: "deathword", Guesser: "testClient1"})
+	manager.routeEvent(Event{Type: EventMakeGuess, Payload: guess}, client)
+
+	login := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username": "carol"}`))
+	manager.loginHandler(httptest.NewRecorder(), login)
+	manager.serveWS(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ws?otp=nonesuch", nil))
+
+	defer func(ask func(*Bot, string, string) (openai.ChatCompletionResponse, error)) {
+		askLLMBot = ask
+	}(askLLMBot)
+	bot := &Bot{model: openai.GPT3Dot5Turbo, game: game}
+	askLLMBot = func(bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+		return openai.ChatCompletionResponse{Usage: openai.Usage{PromptTokens: 100, CompletionTokens: 20}}, nil
+	}
+	bot.askLLM(context.Background(), "system", "user")
+	askLLMBot = func(bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+		return openai.ChatCompletionResponse{}, errors.New("connection refused")
+	}
+	bot.askLLM(context.Background(), "system", "user")
+	if game.usage != (Usage{Calls: 1, PromptTokens: 100, CompletionTokens: 20, TotalTokens: 120}) {
+		t.Errorf("game usage: %+v", game.usage)
+	}
+
+	body := scrapeMetrics(t, manager)
+	for _, want := range []string{
+		`garbanzo_connected_clients 2`,
+		`garbanzo_active_games 0`,
+		`garbanzo_events_handled_total{type="unknown"} 1`,
+		`garbanzo_events_handled_total{type="guess_event"} 1`,
+		`garbanzo_event_errors_total{code="bad_payload",type="send_message"} 1`,
+		`garbanzo_event_errors_total{code="unknown_event",type="unknown"} 1`,
+		`garbanzo_otps_issued_total 1`,
+		`garbanzo_otps_rejected_total{reason="invalid"} 1`,
+		`garbanzo_games_finished_total{cause="assassin"} 1`,
+		`garbanzo_llm_request_duration_seconds_count{model="gpt-3.5-turbo"} 2`,
+		`garbanzo_llm_request_errors_total{model="gpt-3.5-turbo"} 1`,
+		`garbanzo_llm_tokens_total{kind="prompt",model="gpt-3.5-turbo"} 100`,
+		`garbanzo_llm_tokens_total{kind="completion",model="gpt-3.5-turbo"} 20`,
+		`garbanzo_outbound_queue_depth `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %v", want)
+		}
+	}
+}
+
+/* A game every player leaves mid-game is no longer active. */
+func TestMetricsAbandonedGame(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	alice := NewClient("alice", nil, manager)
+	bob := NewClient("bob", nil, manager)
+	bob.role = cluegiver
+	manager.addClient(alice)
+	manager.addClient(bob)
+	den, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: den}, alice)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: den}, bob)
+	manager.routeEvent(Event{Type: EventNewGame, Payload: json.RawMessage(`{}`)}, alice)
+	waitForEvent(t, bob, EventNewGame)
+	if body := scrapeMetrics(t, manager); !strings.Contains(body, "garbanzo_active_games 1") {
+		t.Fatal("game not counted as active")
+	}
+
+	lobby, _ := json.Marshal(ChangeRoomEvent{RoomName: defaultChatRoom})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: lobby}, alice)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: lobby}, bob)
+	manager.room(defaultChatRoom).do(func() error { return nil })
+	body := scrapeMetrics(t, manager)
+	for _, want := range []string{
+		`garbanzo_active_games 0`,
+		`garbanzo_games_finished_total{cause="abandoned"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %v", want)
+		}
+	}
+}
@@ -2,21 +2,40 @@ package main
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+/* How long a one-time password from /login stays valid. */
+var otpLifetime = 5 * time.Second
+
 type OTP struct {
 	Username string
 	Key      string
 	Created  time.Time
 }
 
-type RetentionMap map[string]OTP
+/* One-time passwords handed out by /login and spent by /ws.
+   Implementations must be safe for concurrent use. */
+type OTPStore interface {
+	NewOTP(username string) (OTP, error)
+	/* The user the password was issued to, or "" if it is unknown,
+	   expired or already spent. A password verifies only once. */
+	VerifyOTP(key string) (string, error)
+}
+
+/* In-memory OTPs, for a single server instance. */
+type RetentionMap struct {
+	sync.Mutex
+	otps map[string]OTP
+}
 
-func NewRetentionMap(ctx context.Context, retentionPeriod time.Duration) RetentionMap {
-	rm := make(RetentionMap)
+func NewRetentionMap(ctx context.Context, retentionPeriod time.Duration) *RetentionMap {
+	rm := &RetentionMap{
+		otps: make(map[string]OTP),
+	}
 
 	// spawn a process that runs in the background and checks for expired OTPs
 	go rm.Retention(ctx, retentionPeriod)
@@ -24,39 +43,82 @@ func NewRetentionMap(ctx context.Context, retentionPeriod time.Duration) Retenti
 	return rm
 }
 
-func (rm RetentionMap) NewOTP(username string) OTP {
+func (rm *RetentionMap) NewOTP(username string) (OTP, error) {
 	otp := OTP{
 		Username: username,
 		Key:      uuid.NewString(),
 		Created:  time.Now(),
 	}
 
-	rm[otp.Key] = otp
-	return otp
+	rm.Lock()
+	defer rm.Unlock()
+
+	rm.otps[otp.Key] = otp
+	return otp, nil
 }
 
-func (rm RetentionMap) VerifyOTP(otp string) string {
-	if _, exists := rm[otp]; !exists {
-		return ""
+func (rm *RetentionMap) VerifyOTP(key string) (string, error) {
+	rm.Lock()
+	defer rm.Unlock()
+
+	otp, exists := rm.otps[key]
+	if !exists {
+		return "", nil
 	}
-	username := rm[otp].Username
-	delete(rm, otp)
-	return username
+	delete(rm.otps, key)
+	return otp.Username, nil
 }
 
-func (rm RetentionMap) Retention(ctx context.Context, retentionPeriod time.Duration) {
+func (rm *RetentionMap) Retention(ctx context.Context, retentionPeriod time.Duration) {
 	ticker := time.NewTicker(400 * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			for _, otp := range rm {
+			rm.Lock()
+			for key, otp := range rm.otps {
 				if otp.Created.Add(retentionPeriod).Before(time.Now()) {
-					delete(rm, otp.Key)
+					delete(rm.otps, key)
 				}
 			}
+			rm.Unlock()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+/* OTPs kept as claims in the broker, so a user may log in on one
+   instance and connect to another. The broker expires them. */
+type SharedOTPStore struct {
+	broker   Broker
+	lifetime time.Duration
+}
+
+func NewSharedOTPStore(broker Broker, lifetime time.Duration) *SharedOTPStore {
+	return &SharedOTPStore{
+		broker:   broker,
+		lifetime: lifetime,
+	}
+}
+
+func otpClaim(key string) string {
+	return "otp." + key
+}
+
+func (s *SharedOTPStore) NewOTP(username string) (OTP, error) {
+	otp := OTP{
+		Username: username,
+		Key:      uuid.NewString(),
+		Created:  time.Now(),
+	}
+	if _, err := s.broker.Claim(otpClaim(otp.Key), username, s.lifetime); err != nil {
+		return OTP{}, err
+	}
+	return otp, nil
+}
+
+func (s *SharedOTPStore) VerifyOTP(key string) (string, error) {
+	return s.broker.Take(otpClaim(key))
+}
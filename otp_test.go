@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* Many users log in and spend their passwords at once, and each
+   password verifies exactly once. */
+func checkOTPStore(t *testing.T, store OTPStore) {
+	t.Helper()
+
+	const numUsers = 50
+	var wg sync.WaitGroup
+	var verified atomic.Int64
+	for i := 0; i < numUsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("user%d", i)
+			otp, err := store.NewOTP(name)
+			if err != nil {
+				t.Errorf("NewOTP(%v): %v", name, err)
+				return
+			}
+			/* Two connections racing for the same password. */
+			var spend sync.WaitGroup
+			for j := 0; j < 2; j++ {
+				spend.Add(1)
+				go func() {
+					defer spend.Done()
+					username, err := store.VerifyOTP(otp.Key)
+					if err != nil {
+						t.Errorf("VerifyOTP: %v", err)
+					} else if username == name {
+						verified.Add(1)
+					} else if username != "" {
+						t.Errorf("%v's password verified for %v", name, username)
+					}
+				}()
+			}
+			spend.Wait()
+		}(i)
+	}
+	wg.Wait()
+
+	if verified.Load() != numUsers {
+		t.Errorf("expected %v passwords verified, got %v", numUsers, verified.Load())
+	}
+	if username, _ := store.VerifyOTP("nonesuch"); username != "" {
+		t.Errorf("unknown password verified for %v", username)
+	}
+}
+
+func TestRetentionMap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewRetentionMap(ctx, 100*time.Millisecond)
+	checkOTPStore(t, store)
+
+	otp, _ := store.NewOTP("late")
+	time.Sleep(600 * time.Millisecond)
+	if username, _ := store.VerifyOTP(otp.Key); username != "" {
+		t.Error("expired password verified")
+	}
+}
+
+func TestSharedOTPStore(t *testing.T) {
+	store := NewSharedOTPStore(NewLocalBroker(), 100*time.Millisecond)
+	checkOTPStore(t, store)
+
+	otp, _ := store.NewOTP("late")
+	time.Sleep(200 * time.Millisecond)
+	if username, _ := store.VerifyOTP(otp.Key); username != "" {
+		t.Error("expired password verified")
+	}
+}
+
+/* Users log in and connect while others do the same, through
+   loginHandler and serveWS. With a shared store they log in on one
+   instance and connect to another. */
+func TestConcurrentLogin(t *testing.T) {
+	websocketUpgrader.CheckOrigin = func(r *http.Request) bool { return true }
+
+	serve := func(m *Manager) *httptest.Server {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/login", m.loginHandler)
+		mux.HandleFunc("/ws", m.serveWS)
+		s := httptest.NewServer(mux)
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	memory := NewManager(context.Background())
+	local := serve(memory)
+
+	broker := NewLocalBroker()
+	managerA, err := NewManagerWithBroker(context.Background(), broker, "A", NewSharedOTPStore(broker, otpLifetime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	managerB, err := NewManagerWithBroker(context.Background(), broker, "B", NewSharedOTPStore(broker, otpLifetime))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := NewLocalBroker()
+	tokensC, _ := NewTokenStore(testTokenKey, otpLifetime, tokens)
+	managerC, err := NewManagerWithBroker(context.Background(), tokens, "C", tokensC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokensD, _ := NewTokenStore(testTokenKey, otpLifetime, tokens)
+	managerD, err := NewManagerWithBroker(context.Background(), tokens, "D", tokensD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* Every user logs in from the same address. */
+	unlimitedLogins(memory, managerA, managerB, managerC, managerD)
+
+	tests := []struct {
+		name    string
+		login   *httptest.Server
+		connect *httptest.Server
+	}{
+		{"memory", local, local},
+		{"shared", serve(managerA), serve(managerB)},
+		{"token", serve(managerC), serve(managerD)},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			const numUsers = 20
+			var wg sync.WaitGroup
+			for i := 0; i < numUsers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					name := fmt.Sprintf("%v%d", test.name, i)
+					resp, err := http.Post(test.login.URL+"/login", "application/json",
+						strings.NewReader(`{"username": "`+name+`"}`))
+					if err != nil {
+						t.Errorf("%v could not log in: %v", name, err)
+						return
+					}
+					var login struct {
+						OTP string `json:"otp"`
+					}
+					err = json.NewDecoder(resp.Body).Decode(&login)
+					resp.Body.Close()
+					if err != nil || resp.StatusCode != http.StatusOK {
+						t.Errorf("%v could not log in: %v %v", name, resp.StatusCode, err)
+						return
+					}
+
+					u := "ws" + strings.TrimPrefix(test.connect.URL, "http") + "/ws?otp=" + login.OTP
+					ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+					if err != nil {
+						t.Errorf("%v could not connect: %v", name, err)
+						return
+					}
+					ws.Close()
+
+					/* The password is spent. */
+					if _, _, err := websocket.DefaultDialer.Dial(u, nil); err == nil {
+						t.Errorf("%v connected twice with one password", name)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
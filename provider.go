@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+/* The provider set up from -gpt-key-file and -llm-base-url. */
+const defaultProvider = "openai"
+
+/* Providers by name, set up at startup, and the one bots use. */
+var (
+	llmProviders = map[string]LLMProvider{}
+	botProvider  = defaultProvider
+)
+
+/* A question for a model: a system prompt and a user message. */
+type LLMRequest struct {
+	Model       string
+	System      string
+	User        string
+	/* nil is the provider's default. */
+	Temperature *float32
+}
+
+/* A service bots can ask for completions. */
+type LLMProvider interface {
+	Chat(ctx context.Context, req LLMRequest) (openai.ChatCompletionResponse, error)
+	/* Whether the provider answers. */
+	Ping(ctx context.Context) error
+	/* Whether it has what it needs to be asked, e.g. an API key. */
+	Configured() bool
+}
+
+/* Where a provider is and how to sign in to it. */
+type ProviderConfig struct {
+	/* An OpenAI-compatible API, e.g. http://localhost:11434/v1 for
+	   Ollama or http://localhost:8080/v1 for llama.cpp. Empty is
+	   OpenAI's. */
+	BaseURL string `json:"baseUrl"`
+	/* API key; KeyFile is read if it is empty. Local servers
+	   usually need neither. */
+	Key     string `json:"key"`
+	KeyFile string `json:"keyFile"`
+}
+
+func (pc ProviderConfig) validate(name string) error {
+	if pc.BaseURL == "" {
+		return nil
+	}
+	u, err := url.Parse(pc.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("provider %v: base URL must be an http:// or https:// URL", name)
+	}
+	return nil
+}
+
+/* The key itself if given, else the contents of the file. No key,
+   and no file, is no key. */
+func (pc ProviderConfig) readKey() (string, error) {
+	if pc.Key != "" {
+		return pc.Key, nil
+	}
+	if pc.KeyFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(pc.KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read API key: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+/* OpenAI, or any server with the same API. */
+type openAIProvider struct {
+	client  *openai.Client
+	key     string
+	baseURL string
+}
+
+func NewOpenAIProvider(pc ProviderConfig) (LLMProvider, error) {
+	key, err := pc.readKey()
+	if err != nil {
+		return nil, err
+	}
+	config := openai.DefaultConfig(key)
+	if pc.BaseURL != "" {
+		config.BaseURL = strings.TrimSuffix(pc.BaseURL, "/")
+	}
+	return &openAIProvider{
+		client:  openai.NewClientWithConfig(config),
+		key:     key,
+		baseURL: pc.BaseURL,
+	}, nil
+}
+
+/* go-openai leaves a zero temperature out of the request, as the field
+   is omitempty, and the server then uses its default, usually 1. A zero
+   temperature is sent as this instead: close enough to zero that the
+   answer is the same, and a plain number that every server parses. */
+const zeroTemperature = 1e-6
+
+func (p *openAIProvider) Chat(ctx context.Context, req LLMRequest) (openai.ChatCompletionResponse, error) {
+	chat := openai.ChatCompletionRequest{
+		Model: req.Model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: req.System,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: req.User,
+			},
+		},
+	}
+	if req.Temperature != nil {
+		chat.Temperature = max(*req.Temperature, zeroTemperature)
+	}
+	resp, err := p.client.CreateChatCompletion(ctx, chat)
+	if err == nil && len(resp.Choices) == 0 {
+		err = errors.New("no choices in response")
+	}
+	return resp, err
+}
+
+func (p *openAIProvider) Ping(ctx context.Context) error {
+	_, err := p.client.ListModels(ctx)
+	return err
+}
+
+/* OpenAI needs a key; other servers may not. */
+func (p *openAIProvider) Configured() bool {
+	return p.key != "" || p.baseURL != ""
+}
+
+/* Set up the providers: the default one from -gpt-key-file and
+   -llm-base-url, and those named in the config file, which may
+   replace it. */
+func setupProviders(cfg *Config) (map[string]LLMProvider, error) {
+	configs := map[string]ProviderConfig{
+		defaultProvider: {BaseURL: cfg.LLMBaseURL, KeyFile: cfg.GPTKeyFile},
+	}
+	for name, pc := range cfg.Providers {
+		configs[name] = pc
+	}
+
+	providers := make(map[string]LLMProvider, len(configs))
+	for name, pc := range configs {
+		provider, err := NewOpenAIProvider(pc)
+		if err != nil {
+			return nil, fmt.Errorf("provider %v: %v", name, err)
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+/* The provider bots use, or nil if there is none by that name. */
+func botLLM() LLMProvider {
+	return llmProviders[botProvider]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+/* A local OpenAI-compatible server: a spymaster clue, else guesses. */
+func fakeLLMServer(t *testing.T, key string) (*httptest.Server, *[]openai.ChatCompletionRequest) {
+	t.Helper()
+
+	var (
+		mu       sync.Mutex
+		requests []openai.ChatCompletionRequest
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+key {
+			http.Error(w, `{"error": {"message": "bad key"}}`, http.StatusUnauthorized)
+			return
+		}
+		var req openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		content := "BLUEWORD NEUTRALWORD"
+		if strings.Contains(req.Messages[0].Content, "Spymaster") {
+			content = "Clue: Azure\nNumber of words that match the clue: 2\n" +
+				"Words that match the clue: BLUEWORD, OTHERBLUE"
+		}
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Model: req.Model,
+			Choices: []openai.ChatCompletionChoice{
+				{Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}},
+			},
+			Usage: openai.Usage{PromptTokens: 50, CompletionTokens: 10, TotalTokens: 60},
+		})
+	})
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(openai.ModelsList{Models: []openai.Model{{ID: "llama3"}}})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestOpenAICompatibleProvider(t *testing.T) {
+	server, requests := fakeLLMServer(t, "local-key")
+	/* Other tests leave mocks in place. */
+	defer func(ask func(*Bot, string, string) (openai.ChatCompletionResponse, error)) {
+		askLLMBot = ask
+	}(askLLMBot)
+	askLLMBot = askProvider
+	defer func(providers map[string]LLMProvider, provider string, model string) {
+		llmProviders, botProvider, botModel = providers, provider, model
+	}(llmProviders, botProvider, botModel)
+	cfg := DefaultConfig()
+	cfg.GPTKeyFile = "nonesuch.txt"
+	cfg.Providers = map[string]ProviderConfig{
+		"local": {BaseURL: server.URL + "/v1/", Key: "local-key"},
+	}
+	providers, err := setupProviders(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if providers[defaultProvider].Configured() || !providers["local"].Configured() {
+		t.Error("OpenAI without a key, or the local server with one, is not configured as expected")
+	}
+	llmProviders, botProvider, botModel = providers, "local", "llama3"
+	if err := probeLLM(context.Background()); err != nil {
+		t.Errorf("ping: %v", err)
+	}
+
+	/* The whole bot path, through the fake server. */
+	manager := setupGame(t, nil, &BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Blue: true},
+		Seats: []BotSeat{
+			{Team: blue, Role: cluegiver, Persona: "bold", Temperature: temperature(0)},
+			{Team: blue, Role: guesser, Temperature: temperature(0.7)},
+		},
+	})
+	manager.makeChatRoom("test")
+	game := manager.games["test"]
+	game.cards = Deck{
+		"BLUEWORD":    "blue",
+		"OTHERBLUE":   "blue",
+		"NEUTRALWORD": "neutral",
+		"REDWORD":     "red",
+		"DEATHWORD":   deathCard,
+	}
+	game.teamTurn = blue
+	game.roleTurn = cluegiver
+	if err := game.botPlay(GiveClueEvent{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 2 || (*requests)[0].Model != "llama3" {
+		t.Fatalf("requests: %+v", *requests)
+	}
+	/* Each seat's settings. A zero temperature is still sent. */
+	clue, guess := (*requests)[0], (*requests)[1]
+	if clue.Temperature != zeroTemperature || !strings.Contains(clue.Messages[0].Content, "Play boldly") {
+		t.Errorf("clue request: %v, %q", clue.Temperature, clue.Messages[0].Content)
+	}
+	if guess.Temperature != 0.7 || strings.Contains(guess.Messages[0].Content, "Play boldly") {
+		t.Errorf("guess request: %v, %q", guess.Temperature, guess.Messages[0].Content)
+	}
+	if len(game.transcript) != 2 || game.transcript[0].Persona != "bold" || game.transcript[0].Clue != "Azure" ||
+		slices.Compare(game.transcript[1].Played, []string{"BLUEWORD", "NEUTRALWORD"}) != 0 {
+		t.Errorf("transcript: %+v", game.transcript)
+	}
+	if game.usage.TotalTokens != 120 {
+		t.Errorf("usage: %+v", game.usage)
+	}
+	if game.teamTurn != red || game.roleTurn != cluegiver {
+		t.Errorf("turn after the bots: %v %v", game.teamTurn, game.roleTurn)
+	}
+
+	/* A wrong key is an error, not a panic. */
+	llmProviders["local"], _ = NewOpenAIProvider(ProviderConfig{BaseURL: server.URL + "/v1", Key: "wrong"})
+	bot := NewBot(game, &game.bots)
+	if _, err := bot.askLLM(context.Background(), "system", "user"); err == nil {
+		t.Error("wrong key accepted")
+	}
+}
+
+/* What is sent for each temperature: a zero one can't be left out, or
+   the server would use its default. */
+func TestZeroTemperature(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: "ok"}}},
+		})
+	}))
+	defer server.Close()
+	provider, err := NewOpenAIProvider(ProviderConfig{BaseURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		temperature *float32
+		want        string
+	}{
+		{"zero", temperature(0), `"temperature":0.000001`},
+		{"0.7", temperature(0.7), `"temperature":0.7`},
+		{"default", nil, ""},
+	} {
+		if _, err := provider.Chat(context.Background(), LLMRequest{Model: "llama3", Temperature: test.temperature}); err != nil {
+			t.Fatal(err)
+		}
+		body := <-bodies
+		if test.want == "" && strings.Contains(body, "temperature") || !strings.Contains(body, test.want) {
+			t.Errorf("%v temperature: sent %s", test.name, body)
+		}
+	}
+}
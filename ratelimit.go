@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* Allows Rate events per second on average, and bursts of up to
+   Burst at once. Written "<rate>:<burst>", e.g. "5:10". */
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func ParseRateLimit(s string) (RateLimit, error) {
+	rate, burst, found := strings.Cut(s, ":")
+	if !found {
+		return RateLimit{}, fmt.Errorf("rate limit must be <rate>:<burst>, e.g. 5:10: %v", s)
+	}
+	var (
+		limit RateLimit
+		err   error
+	)
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil || limit.Rate <= 0 {
+		return RateLimit{}, fmt.Errorf("bad rate in rate limit %v", s)
+	}
+	if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 1 {
+		return RateLimit{}, fmt.Errorf("bad burst in rate limit %v", s)
+	}
+	return limit, nil
+}
+
+func (l RateLimit) String() string {
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + ":" + strconv.Itoa(l.Burst)
+}
+
+func (l *RateLimit) Set(s string) error {
+	parsed, err := ParseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+func (l RateLimit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *RateLimit) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate limit must be a string such as \"5:10\": %s", data)
+	}
+	return l.Set(s)
+}
+
+/* Rate limits by event type, written "<type>=<limit>,...". */
+type EventLimits map[string]RateLimit
+
+func ParseEventLimits(s string) (EventLimits, error) {
+	limits := make(EventLimits)
+	if s == "" {
+		return limits, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		eventType, limit, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			return nil, fmt.Errorf("event limit must be <event type>=<rate>:<burst>: %v", item)
+		}
+		l, err := ParseRateLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		limits[eventType] = l
+	}
+	return limits, nil
+}
+
+/* Adds to the limits, keeping those for other types. */
+func (el *EventLimits) Set(s string) error {
+	parsed, err := ParseEventLimits(s)
+	if err != nil {
+		return err
+	}
+	if *el == nil {
+		*el = make(EventLimits)
+	}
+	for eventType, limit := range parsed {
+		(*el)[eventType] = limit
+	}
+	return nil
+}
+
+func (el EventLimits) String() string {
+	items := make([]string, 0, len(el))
+	for eventType, limit := range el {
+		items = append(items, eventType+"="+limit.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+var (
+	/* Logins per client IP address. */
+	loginLimit = RateLimit{Rate: 0.5, Burst: 5}
+	/* New chat rooms per client. */
+	roomLimit = RateLimit{Rate: 0.1, Burst: 10}
+	/* Events per client, for types not in eventLimits. */
+	defaultEventLimit = RateLimit{Rate: 5, Burst: 10}
+	/* Starting games and asking for stats cost the most. */
+	eventLimits = EventLimits{
+		EventGiveClue:  {Rate: 1, Burst: 3},
+		EventNewGame:   {Rate: 0.2, Burst: 2},
+		EventRematch:   {Rate: 0.2, Burst: 2},
+		EventAbortGame: {Rate: 0.2, Burst: 2},
+		EventEnterRoom: {Rate: 1, Burst: 5},
+		EventGetStats:  {Rate: 0.5, Burst: 3},
+	}
+	/* A client with banStrikes throttled events within banWindow is
+	   disconnected, and its address refused for banDuration. */
+	banStrikes  = 50
+	banWindow   = time.Minute
+	banDuration = 10 * time.Minute
+	/* Take client addresses from X-Forwarded-For, set by a reverse proxy. */
+	trustProxy = false
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/* Take a token if there is one. Otherwise returns how long until there is. */
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > float64(limit.Burst) {
+			b.tokens = float64(limit.Burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+/* Token buckets by key, e.g. IP address, safe for concurrent use. */
+type rateLimiter struct {
+	sync.Mutex
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	/* A full bucket is the same as none; forget those now and then. */
+	if len(rl.buckets) > 1000 {
+		full := time.Duration(float64(rl.limit.Burst) / rl.limit.Rate * float64(time.Second))
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > full {
+				delete(rl.buckets, k)
+			}
+		}
+	}
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &tokenBucket{}
+		rl.buckets[key] = b
+	}
+	return b.take(rl.limit, now)
+}
+
+/* Addresses refused until a time, safe for concurrent use. */
+type banList struct {
+	sync.Mutex
+	until map[string]time.Time
+}
+
+func (bl *banList) ban(addr string, d time.Duration) {
+	bl.Lock()
+	defer bl.Unlock()
+
+	now := time.Now()
+	/* Forget bans that have run out now and then, as addresses that
+	   never come back are not forgotten when they do. */
+	if len(bl.until) > 1000 {
+		for a, until := range bl.until {
+			if !now.Before(until) {
+				delete(bl.until, a)
+			}
+		}
+	}
+	bl.until[addr] = now.Add(d)
+}
+
+func (bl *banList) banned(addr string) bool {
+	bl.Lock()
+	defer bl.Unlock()
+
+	until, exists := bl.until[addr]
+	if exists && !time.Now().Before(until) {
+		delete(bl.until, addr)
+		return false
+	}
+	return exists
+}
+
+/* The address the request came from. */
+func clientAddr(r *http.Request) string {
+	if trustProxy {
+		/* The proxy appends the address it saw to any the client sent. */
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/* Per-client event budgets. Only used on the client's readMessages
+   goroutine, so unguarded. */
+type eventBudget struct {
+	buckets map[string]*tokenBucket
+	/* Throttled events since windowStart. */
+	strikes     int
+	windowStart time.Time
+	/* A throttled event was reported and nothing was allowed since. */
+	notified    map[string]bool
+	/* Events still arriving from a banned client are ignored. */
+	banned      bool
+}
+
+/* The budget, and metrics label, of event types without a handler. */
+const unknownEventType = "unknown"
+
+func limitFor(eventType string) RateLimit {
+	if limit, exists := eventLimits[eventType]; exists {
+		return limit
+	}
+	return defaultEventLimit
+}
+
+/* Check the client's budget for an event. Returns false if the event
+   must be dropped; the client has then been told, or banned. */
+func (m *Manager) allowEvent(event Event, c *Client) bool {
+	budget := &c.budget
+	if budget.banned {
+		return false
+	}
+	if budget.buckets == nil {
+		budget.buckets = make(map[string]*tokenBucket)
+		budget.notified = make(map[string]bool)
+	}
+	/* Unknown types share one budget, so that making up new ones
+	   buys no more events. */
+	key := event.Type
+	if _, known := m.handlers[key]; !known {
+		key = unknownEventType
+	}
+	bucket, exists := budget.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{}
+		budget.buckets[key] = bucket
+	}
+
+	now := time.Now()
+	ok, wait := bucket.take(limitFor(key), now)
+	if ok {
+		budget.notified[key] = false
+		return true
+	}
+
+	m.throttledEvents.Add(1)
+	if now.Sub(budget.windowStart) > banWindow {
+		budget.windowStart = now
+		budget.strikes = 0
+	}
+	budget.strikes++
+	if budget.strikes >= banStrikes {
+		budget.banned = true
+		m.banClient(c)
+		return false
+	}
+
+	/* Once per burst of throttled events, not for each one. */
+	if !budget.notified[key] {
+		budget.notified[key] = true
+		c.throttled(event.RequestID, ThrottledEvent{
+			Event:      event.Type,
+			RetryAfter: wait.Milliseconds(),
+			Message:    "You are sending " + event.Type + " too fast. Slow down.",
+		})
+	}
+	return false
+}
+
+func (c *Client) throttled(requestID string, throttled ThrottledEvent) {
+	c.sendResponse(EventThrottled, requestID, throttled)
+}
+
+/* Disconnect a client that keeps flooding, and refuse its address for a while. */
+func (m *Manager) banClient(c *Client) {
+	c.logger().Warn().Str("addr", c.addr).Dur("for", banDuration).
+		Msg("banning client for flooding")
+	m.bannedClients.Add(1)
+	if c.addr != "" {
+		m.bans.ban(c.addr, banDuration)
+	}
+	c.throttled("", ThrottledEvent{
+		Banned:     true,
+		RetryAfter: banDuration.Milliseconds(),
+		Message:    "Too many messages. You have been disconnected; try again in " + banDuration.String() + ".",
+	})
+	c.close(websocket.ClosePolicyViolation, "flooding", time.Now().Add(time.Second))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unlimitedLogins(managers ...*Manager) {
+	for _, m := range managers {
+		m.loginLimiter = newRateLimiter(RateLimit{Rate: 1000, Burst: 1000})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 3}
+	var b tokenBucket
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(limit, now); !ok {
+			t.Fatalf("event %v of the burst refused", i)
+		}
+	}
+	ok, wait := b.take(limit, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %v, %v", ok, wait)
+	}
+	if ok, _ := b.take(limit, now.Add(500*time.Millisecond)); !ok {
+		t.Error("token not refilled")
+	}
+	/* Never more than the burst. */
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		ok, _ := b.take(limit, now)
+		if ok != (i < 3) {
+			t.Errorf("event %v after an hour: allowed %v", i, ok)
+		}
+	}
+}
+
+func TestParseEventLimits(t *testing.T) {
+	limits, err := ParseEventLimits("send_message=5:10, new_game=0.2:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[EventSendMessage] != (RateLimit{5, 10}) || limits[EventNewGame] != (RateLimit{0.2, 2}) {
+		t.Errorf("parsed %v", limits)
+	}
+	if limits.String() != "new_game=0.2:2,send_message=5:10" {
+		t.Errorf("formatted %v", limits.String())
+	}
+	for _, bad := range []string{"send_message", "send_message=5", "send_message=0:10", "send_message=5:0", "send_message=x:1"} {
+		if _, err := ParseEventLimits(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestLoginLimit(t *testing.T) {
+	manager := NewManager(context.Background())
+	manager.loginLimiter = newRateLimiter(RateLimit{Rate: 0.001, Burst: 2})
+
+	login := func(name string, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username": "`+name+`"}`))
+		r.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		manager.loginHandler(w, r)
+		return w
+	}
+	login("a1", "192.0.2.1")
+	login("a2", "192.0.2.1")
+	if w := login("a3", "192.0.2.1"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("third login: got %v, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := login("b1", "192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("login from another address: got %v", w.Code)
+	}
+
+	manager.bans.ban("192.0.2.2", time.Minute)
+	if w := login("b2", "192.0.2.2"); w.Code != http.StatusForbidden {
+		t.Errorf("login from a banned address: got %v", w.Code)
+	}
+}
+
+func TestEventLimit(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	client := NewClient("flooder", nil, manager)
+	client.addr = "192.0.2.3"
+	manager.addClient(client)
+
+	saved := banStrikes
+	banStrikes = 5
+	defer func() { banStrikes = saved }()
+
+	message, _ := json.Marshal(SendMessageEvent{Message: "spam", From: "flooder"})
+	event := Event{Type: EventSendMessage, Payload: message}
+	burst := limitFor(EventSendMessage).Burst
+	for i := 0; i < burst; i++ {
+		if !manager.allowEvent(event, client) {
+			t.Fatalf("message %v of the burst refused", i)
+		}
+	}
+
+	/* Told once, not for every dropped message. */
+	for i := 0; i < banStrikes-1; i++ {
+		if manager.allowEvent(event, client) {
+			t.Fatal("message past the burst allowed")
+		}
+	}
+	var throttled ThrottledEvent
+	json.Unmarshal(waitForEvent(t, client, EventThrottled).Payload, &throttled)
+	if throttled.Event != EventSendMessage || throttled.RetryAfter <= 0 || throttled.Banned {
+		t.Errorf("throttled event: %+v", throttled)
+	}
+	if len(client.egress) != 0 {
+		t.Errorf("%v more events queued", len(client.egress))
+	}
+
+	/* Other event types have their own budgets. */
+	if !manager.allowEvent(Event{Type: EventChangeTeam}, client) {
+		t.Error("change_team throttled by send_message")
+	}
+
+	/* One more strike and the client is banned. */
+	manager.allowEvent(event, client)
+	json.Unmarshal(waitForEvent(t, client, EventThrottled).Payload, &throttled)
+	if !throttled.Banned {
+		t.Errorf("expected a ban, got %+v", throttled)
+	}
+	if !manager.bans.banned("192.0.2.3") {
+		t.Error("address not banned")
+	}
+	if manager.throttledEvents.Load() != uint64(banStrikes) || manager.bannedClients.Load() != 1 {
+		t.Errorf("counted %v throttled events and %v bans", manager.throttledEvents.Load(), manager.bannedClients.Load())
+	}
+}
+
+/* Made-up event types share one budget, and count towards a ban. */
+func TestUnknownEventLimit(t *testing.T) {
+	manager := NewManager(context.Background())
+	client := NewClient("prober", nil, manager)
+	manager.addClient(client)
+
+	burst := defaultEventLimit.Burst
+	for i := 0; i < burst; i++ {
+		manager.routeEvent(Event{Type: fmt.Sprintf("nonesuch%d", i)}, client)
+	}
+	if err := manager.routeEvent(Event{Type: "another"}, client); err != nil {
+		t.Errorf("unknown event past the burst answered: %v", err)
+	}
+	if manager.throttledEvents.Load() != 1 {
+		t.Errorf("counted %v throttled events", manager.throttledEvents.Load())
+	}
+}
+
+/* Bans that ran out are forgotten, even if the address never returns. */
+func TestBanListPrune(t *testing.T) {
+	bans := banList{until: make(map[string]time.Time)}
+	for i := 0; i < 1000; i++ {
+		bans.ban(fmt.Sprintf("192.0.2.%d", i), -time.Second)
+	}
+	bans.ban("198.51.100.1", time.Minute)
+	bans.ban("198.51.100.2", time.Minute)
+	if len(bans.until) != 2 || !bans.banned("198.51.100.1") {
+		t.Errorf("%v bans kept", len(bans.until))
+	}
+}
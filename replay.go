@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/* How a game ended. */
+const (
+	OutcomeAssassin  = "assassin"
+	OutcomeAllCards  = "all_cards"
+	OutcomeAbandoned = "abandoned"
+	/* Ended by a server shutdown. */
+	OutcomeInterrupted = "interrupted"
+	/* Ended by an admin. */
+	OutcomeStopped     = "stopped"
+	/* Ended when the bots' budget ran out and nobody could take
+	   their turns. */
+	OutcomeOverBudget  = "over_budget"
+)
+
+/* Everything needed to step through a finished game: the board as
+   laid out for the players (alphabetical, as the frontend shows it),
+   the key card, and every action with the score after it. This is
+   also what the game store keeps. */
+type GameRecord struct {
+	ID       string        `json:"id"`
+	Room     string        `json:"room"`
+	Started  time.Time     `json:"started"`
+	Ended    time.Time     `json:"ended"`
+	Players  []Participant `json:"players"`
+	Bots     BotActions    `json:"bots"`
+	/* Games from before bot seats had their own models. */
+	BotModel string        `json:"botModel,omitempty"`
+	Board    []string      `json:"board"`
+	KeyCard  Deck          `json:"keyCard"`
+	Steps    GameLog       `json:"steps"`
+	Winner   Team          `json:"winner,omitempty"`
+	Cause    string        `json:"cause"`
+	Message  string        `json:"message"`
+	/* Served by /transcript rather than /replay. */
+	Transcript []BotTurn   `json:"transcript,omitempty"`
+}
+
+/* Names of everyone who played in the game. */
+func (r *GameRecord) usernames() []string {
+	names := make([]string, 0, len(r.Players))
+	for _, p := range r.Players {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func (game *Game) gameRecord() *GameRecord {
+	board := make([]string, 0, len(game.cards))
+	for card := range game.cards {
+		board = append(board, card)
+	}
+	sort.Strings(board)
+
+	r := &GameRecord{
+		ID:      game.id,
+		Room:    game.name,
+		Ended:   time.Now(),
+		Players: game.players.listClients(),
+		Bots:    game.bots,
+		Board:   board,
+		KeyCard: game.cards.keyCard(),
+		Steps:   game.history,
+		Winner:  game.winner,
+		Cause:   game.cause,
+	}
+	if len(game.transcript) > 0 {
+		r.Transcript = game.botTranscript()
+	}
+	if r.Cause == "" {
+		r.Cause = OutcomeAbandoned
+	}
+	if len(game.history) > 0 {
+		r.Started = game.history[0].Time
+		last := game.history[len(game.history)-1]
+		if last.Action == LogGameOver {
+			r.Message = last.Result
+		}
+	}
+	return r
+}
+
+/* Save a finished game to the game store. */
+func (m *Manager) archiveGame(game *Game) {
+	record := game.gameRecord()
+	m.metrics.gameOutcomes.WithLabelValues(record.Cause).Inc()
+	if err := m.saveRecord(record); err != nil {
+		game.log.Error().Err(err).Msg("could not save game")
+	}
+}
+
+func (m *Manager) replayHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing game id", http.StatusBadRequest)
+		return
+	}
+
+	record, err := m.store.Get(id)
+	if errors.Is(err, ErrGameNotFound) {
+		http.Error(w, "game "+id+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replay := *record
+	replay.Transcript = nil
+	writeJSON(w, &replay)
+}
+
+/* Summary of a stored game, for listing. */
+type GameSummary struct {
+	ID      string        `json:"id"`
+	Room    string        `json:"room"`
+	Started time.Time     `json:"started"`
+	Ended   time.Time     `json:"ended"`
+	Players []Participant `json:"players"`
+	Winner  Team          `json:"winner,omitempty"`
+	Cause   string        `json:"cause"`
+}
+
+/* List stored games by user, room or date range, e.g.
+   /games?user=alice, /games?room=den, or
+   /games?from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z */
+func (m *Manager) gamesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var (
+		records []*GameRecord
+		err     error
+	)
+	switch {
+	case q.Get("user") != "":
+		records, err = m.store.ByUser(q.Get("user"))
+	case q.Get("room") != "":
+		records, err = m.store.ByRoom(q.Get("room"))
+	default:
+		var from, to time.Time
+		if from, err = parseTimeParam(q.Get("from")); err != nil {
+			http.Error(w, "bad 'from' time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to, err = parseTimeParam(q.Get("to")); err != nil {
+			http.Error(w, "bad 'to' time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+		records, err = m.store.ByDate(from, to)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, summarizeGames(records))
+}
+
+func summarizeGames(records []*GameRecord) []GameSummary {
+	summaries := make([]GameSummary, len(records))
+	for i, r := range records {
+		summaries[i] = GameSummary{
+			ID:      r.ID,
+			Room:    r.Room,
+			Started: r.Started,
+			Ended:   r.Ended,
+			Players: r.Players,
+			Winner:  r.Winner,
+			Cause:   r.Cause,
+		}
+	}
+	return summaries
+}
+
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
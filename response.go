@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/* Error codes sent to clients in error events. */
+const (
+	ErrCodeUnknownEvent   = "unknown_event"
+	ErrCodeBadPayload     = "bad_payload"
+	ErrCodeNoRoom         = "no_room"
+	ErrCodeNoGame         = "no_game"
+	ErrCodeGameInProgress = "game_in_progress"
+	ErrCodeInvalidState   = "invalid_state"
+	ErrCodeNotYourTurn    = "not_your_turn"
+	ErrCodeInternal       = "internal"
+
+	/* The client is opening new chat rooms too fast. */
+	ErrCodeTooManyRooms = "too_many_rooms"
+	/* The bots have used up their LLM budget. */
+	ErrCodeBudgetExhausted = "budget_exhausted"
+)
+
+/* An error in a client's request, with the code sent back to the client. */
+type RequestError struct {
+	Code    string
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+func requestError(code string, format string, a ...any) error {
+	return &RequestError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func errorCode(err error) string {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.Code
+	}
+	return ErrCodeInternal
+}
+
+/* Tell the client how its request went: an error event if it failed,
+   or an ack if it succeeded and the client asked for one. Called
+   wherever the request is finally handled, on whichever instance. */
+func (c *Client) respond(request Event, err error) {
+	c.manager.metrics.eventHandled(c.manager, request.Type, err)
+	if err != nil {
+		response := ErrorEvent{
+			Request: request.Type,
+			Code:    errorCode(err),
+			Message: err.Error(),
+		}
+		if response.Code == ErrCodeInternal {
+			c.eventLogger(request).Error().Err(err).Msg("could not handle event")
+			/* Don't show clients the server's internals. */
+			response.Message = "Something went wrong on the server."
+		} else {
+			/* The client's mistake, not the server's. */
+			c.eventLogger(request).Warn().Err(err).Str("code", response.Code).
+				Msg("refused event")
+		}
+		c.sendResponse(EventError, request.RequestID, response)
+		return
+	}
+	if request.Ack {
+		c.sendResponse(EventAck, request.RequestID, AckEvent{Request: request.Type})
+	}
+}
+
+func (c *Client) sendResponse(eventType string, requestID string, response any) {
+	outgoingEvent, err := packageMessage(eventType, response)
+	if err != nil {
+		c.log.Error().Err(err).Msg("could not package response")
+		return
+	}
+	outgoingEvent.RequestID = requestID
+	c.send(outgoingEvent)
+}
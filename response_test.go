@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrorEvents(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	alice := NewClient("alice", nil, manager)
+	manager.addClient(alice)
+
+	expectError := func(event Event, code string) {
+		t.Helper()
+		if err := manager.routeEvent(event, alice); errorCode(err) != code {
+			t.Errorf("%v: expected %v, got %v", event.Type, code, err)
+		}
+		var response ErrorEvent
+		json.Unmarshal(waitForEvent(t, alice, EventError).Payload, &response)
+		if response.Request != event.Type || response.Code != code || response.Message == "" {
+			t.Errorf("%v: error event %+v", event.Type, response)
+		}
+	}
+
+	expectError(Event{Type: "nonesuch"}, ErrCodeUnknownEvent)
+	expectError(Event{Type: EventSendMessage, Payload: json.RawMessage(`"hello"`)}, ErrCodeBadPayload)
+	expectError(Event{Type: EventMakeGuess, Payload: json.RawMessage(`{}`)}, ErrCodeNoGame)
+
+	room, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, alice)
+	waitForEvent(t, alice, EventEnterRoom)
+
+	/* Acks only when asked for. */
+	message, _ := json.Marshal(SendMessageEvent{Message: "hello", From: "alice"})
+	manager.routeEvent(Event{Type: EventSendMessage, Payload: message}, alice)
+	waitForEvent(t, alice, EventNewMessage)
+	manager.routeEvent(Event{Type: EventSendMessage, Payload: message, Ack: true}, alice)
+	waitForEvent(t, alice, EventNewMessage)
+	var ack AckEvent
+	json.Unmarshal(waitForEvent(t, alice, EventAck).Payload, &ack)
+	if ack.Request != EventSendMessage {
+		t.Errorf("ack for %v", ack.Request)
+	}
+	if len(alice.egress) != 0 {
+		t.Errorf("%v unexpected events", len(alice.egress))
+	}
+
+	/* Guessing out of turn, in a game. */
+	bob := NewClient("bob", nil, manager)
+	bob.role = cluegiver
+	manager.addClient(bob)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, bob)
+	manager.routeEvent(Event{Type: EventNewGame, Payload: json.RawMessage(`{}`)}, alice)
+	waitForEvent(t, alice, EventNewGame)
+	guess, _ := json.Marshal(GuessEvent{Guess: "nonesuch", Guesser: "alice"})
+	expectError(Event{Type: EventMakeGuess, Payload: guess}, ErrCodeNotYourTurn)
+
+	/* Internal errors are not shown to clients. */
+	alice.respond(Event{Type: EventGiveClue}, errors.New("openai: connection refused"))
+	var response ErrorEvent
+	json.Unmarshal(waitForEvent(t, alice, EventError).Payload, &response)
+	if response.Code != ErrCodeInternal || strings.Contains(response.Message, "openai") {
+		t.Errorf("internal error sent as %+v", response)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	manager := NewManager(context.Background())
+	alice := NewClient("alice", nil, manager)
+	bob := NewClient("bob", nil, manager)
+	manager.addClient(alice)
+	manager.addClient(bob)
+
+	room, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room, RequestID: "a1"}, alice)
+	if event := waitForEvent(t, alice, EventEnterRoom); event.RequestID != "a1" {
+		t.Errorf("enter_room answered with request %q", event.RequestID)
+	}
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room, RequestID: "b1"}, bob)
+	if event := waitForEvent(t, alice, EventEnterRoom); event.RequestID != "b1" {
+		t.Errorf("bob's entrance broadcast with request %q", event.RequestID)
+	}
+
+	/* Broadcasts carry the ID of the request that caused them. */
+	message, _ := json.Marshal(SendMessageEvent{Message: "hello", From: "alice"})
+	manager.routeEvent(Event{Type: EventSendMessage, Payload: message, RequestID: "a2", Ack: true}, alice)
+	for _, c := range []*Client{alice, bob} {
+		if event := waitForEvent(t, c, EventNewMessage); event.RequestID != "a2" {
+			t.Errorf("%v got new_message for request %q", c.username, event.RequestID)
+		}
+	}
+	if event := waitForEvent(t, alice, EventAck); event.RequestID != "a2" {
+		t.Errorf("ack for request %q", event.RequestID)
+	}
+	manager.routeEvent(Event{Type: EventMakeGuess, Payload: json.RawMessage(`{}`), RequestID: "a3"}, alice)
+	if event := waitForEvent(t, alice, EventError); event.RequestID != "a3" {
+		t.Errorf("error for request %q", event.RequestID)
+	}
+
+	/* Events unrelated to a request carry none. */
+	manager.room("den").do(func() error {
+		return manager.notifyClients("den", EventNewMessage, SendMessageEvent{Message: "notice"})
+	})
+	if event := waitForEvent(t, bob, EventNewMessage); event.RequestID != "" {
+		t.Errorf("notice carries request %q", event.RequestID)
+	}
+}
+
+/* Every event on a connection is numbered, and dropped events leave gaps. */
+func TestSequenceNumbers(t *testing.T) {
+	saved := egressPolicy
+	egressPolicy = EgressDrop
+	defer func() { egressPolicy = saved }()
+
+	client := NewClient("alice", nil, NewManager(context.Background()))
+	for i := 0; i < egressBuffer+5; i++ {
+		client.send(Event{Type: EventNewMessage})
+	}
+	for i := 1; i <= egressBuffer; i++ {
+		if event := <-client.egress; event.Seq != uint64(i) {
+			t.Fatalf("expected event %v, got %v", i, event.Seq)
+		}
+	}
+	client.send(Event{Type: EventNewMessage})
+	if event := <-client.egress; event.Seq != uint64(egressBuffer+6) {
+		t.Errorf("expected a gap before event %v, got %v", egressBuffer+6, event.Seq)
+	}
+}
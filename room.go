@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errQueueClosed = errors.New("task queue closed")
+
+/* Runs tasks one at a time, in order, on its own goroutine. Queueing
+   never blocks, so one queue may hand work to another (e.g. a client
+   moving between rooms) without the two ever waiting on each other.
+   The goroutine only runs while there are tasks, so an idle queue
+   costs nothing and needs no stopping. */
+type taskQueue struct {
+	mu      sync.Mutex
+	tasks   []func()
+	running bool
+	closed  bool
+}
+
+func newTaskQueue() *taskQueue {
+	return &taskQueue{}
+}
+
+func (q *taskQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		q.mu.Unlock()
+
+		task()
+	}
+}
+
+/* Queue a task and return immediately, reporting whether it was
+   queued: a closed queue takes no more tasks. */
+func (q *taskQueue) post(task func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.tasks = append(q.tasks, task)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	return true
+}
+
+/* Close the queue if no tasks are waiting, reporting whether it did.
+   Called from the queue's own goroutine, this closes it once the task
+   running is done. */
+func (q *taskQueue) closeIfIdle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.tasks) > 0 {
+		return false
+	}
+	q.closed = true
+	return true
+}
+
+/* Drop the tasks waiting and refuse any more. A task already running
+   finishes, after which the goroutine stops. */
+func (q *taskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.tasks = nil
+}
+
+/* Run a task on the queue's goroutine and wait for it to finish.
+   Must not be called from a queue's own goroutine. */
+func (q *taskQueue) do(task func() error) error {
+	done := make(chan error, 1)
+	queued := q.post(func() {
+		done <- task()
+	})
+	if !queued {
+		return errQueueClosed
+	}
+	return <-done
+}
+
+/* A chat room and the goroutine that owns it. Every event from a
+   client in the room, and every change to the room's clients and
+   game, runs as a task on the room's queue, one at a time, so
+   handlers never race with each other over a Game or a Client. */
+type Room struct {
+	name    string
+	clients ClientList
+	/* RequestID of the client event being handled, if any. */
+	request string
+	/* Trace context of the span the room is in, if any. */
+	ctx     context.Context
+
+	*taskQueue
+}
+
+type ChatRooms map[string]*Room
+
+/* Handle a client's event on the room's goroutine, stamping the
+   events it causes with its request ID, and tracing it under ctx. */
+func (r *Room) handle(ctx context.Context, event Event, handle func() error) error {
+	r.request = event.RequestID
+	r.ctx = ctx
+	defer func() {
+		r.request = ""
+		r.ctx = nil
+	}()
+
+	_, end := r.startSpan("handle "+event.Type, attrEvent.String(event.Type))
+	err := handle()
+	end(err)
+	return err
+}
+
+func newRoom(name string) *Room {
+	return &Room{
+		name:      name,
+		clients:   make(ClientList),
+		taskQueue: newTaskQueue(),
+	}
+}
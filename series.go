@@ -0,0 +1,92 @@
+package main
+
+/* A series is a run of games played in the same chat room by the
+   same players, e.g. best of 3 or best of 5. The series lasts until
+   one team has won a majority of the games, and is forgotten when
+   the chat room empties. */
+
+type SeriesList map[string]*Series
+
+type Series struct {
+	bestOf int
+	played int
+	wins   Score
+	over   bool
+}
+
+func NewSeries(bestOf int) *Series {
+	if bestOf < 1 {
+		bestOf = 1
+	}
+	/* A best-of-N series needs an odd number of games
+	   so that it cannot end in a tie. */
+	if bestOf%2 == 0 {
+		bestOf++
+	}
+	return &Series{
+		bestOf: bestOf,
+		wins: Score{
+			red:  0,
+			blue: 0,
+		},
+	}
+}
+
+/* Record the winner of a game. Return true if the series is decided. */
+func (s *Series) record(winner Team) bool {
+	if s.over {
+		return true
+	}
+	s.played++
+	if _, err := NewTeam(winner.String()); err == nil {
+		s.wins[winner]++
+	}
+	if s.wins[winner] > s.bestOf/2 || s.played >= s.bestOf {
+		s.over = true
+	}
+	return s.over
+}
+
+func (s *Series) leader() Team {
+	switch {
+	case s.wins[red] > s.wins[blue]:
+		return red
+	case s.wins[blue] > s.wins[red]:
+		return blue
+	default:
+		return ""
+	}
+}
+
+/* Swap the series score between teams, so the score follows
+   the players when they rotate teams in a rematch. */
+func (s *Series) swapTeams() {
+	s.wins[red], s.wins[blue] = s.wins[blue], s.wins[red]
+}
+
+func (s *Series) score() *SeriesEvent {
+	e := &SeriesEvent{
+		BestOf: s.bestOf,
+		Game:   s.played,
+		Wins: Score{
+			red:  s.wins[red],
+			blue: s.wins[blue],
+		},
+		Over: s.over,
+	}
+	if !s.over {
+		/* Number of the game in progress. */
+		e.Game++
+	} else {
+		e.Winner = s.leader()
+	}
+	return e
+}
+
+/* Must be called on the room's goroutine. */
+func (m *Manager) endSeriesIfEmpty(room string) {
+	if r := m.room(room); r != nil && len(r.clients) > 0 {
+		return
+	}
+	m.setSeries(room, nil)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	/* How long shutdown waits for bot calls in flight to finish
+	   before cancelling them. */
+	botShutdownWait = 10 * time.Second
+	/* Whether games still in progress at shutdown are ended and
+	   saved to the game store. Otherwise they are lost. */
+	snapshotOnShutdown = true
+)
+
+const (
+	shutdownMessage     = "The server is restarting. Please log in again in a minute."
+	shutdownGameMessage = "The server is restarting. This game has been saved but cannot be continued."
+)
+
+/* Stop the manager: refuse new logins, warn every client, give bot
+   calls in flight up to botShutdownWait to finish, save the games in
+   progress, and close every websocket with a close frame. Anything
+   still unfinished when ctx is done is abandoned. */
+func (m *Manager) Shutdown(ctx context.Context) {
+	m.closing.Store(true)
+
+	m.RLock()
+	clients := make([]*Client, 0, len(m.clients))
+	for _, client := range m.clients {
+		clients = append(clients, client)
+	}
+	m.RUnlock()
+
+	notice, err := packageMessage(EventServerShutdown, ServerShutdownEvent{Message: shutdownMessage})
+	if err == nil {
+		for _, client := range clients {
+			client.send(notice)
+		}
+	}
+
+	m.waitForBots(ctx)
+	/* Cancel what is left, and stop OTP retention. */
+	m.cancel()
+
+	if snapshotOnShutdown {
+		m.snapshotGames(ctx)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	for _, client := range clients {
+		client.shutdown(deadline)
+	}
+
+	m.releaseClaims()
+	m.unsubscribe()
+	if err := m.broker.Close(); err != nil {
+		log.Error().Err(err).Msg("could not close broker")
+	}
+	if err := m.store.Close(); err != nil {
+		log.Error().Err(err).Msg("could not close game store")
+	}
+}
+
+func (m *Manager) waitForBots(ctx context.Context) {
+	timeout := time.NewTimer(botShutdownWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for m.botCalls.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			log.Warn().Int64("calls", m.botCalls.Load()).Msg("cancelling bot calls in flight")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/* End every game in progress, which saves it to the game store. */
+func (m *Manager) snapshotGames(ctx context.Context) {
+	m.RLock()
+	rooms := make([]*Room, 0, len(m.chats))
+	for _, room := range m.chats {
+		rooms = append(rooms, room)
+	}
+	m.RUnlock()
+
+	pending := make([]chan struct{}, 0, len(rooms))
+	for _, room := range rooms {
+		room := room
+		done := make(chan struct{})
+		pending = append(pending, done)
+		queued := room.post(func() {
+			defer close(done)
+			if game := m.game(room.name); game != nil && game.active {
+				game.cause = OutcomeInterrupted
+				m.removeGame(room.name, shutdownGameMessage)
+			}
+		})
+		/* A closed room had no game. */
+		if !queued {
+			close(done)
+		}
+	}
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Warn().Msg("gave up saving games in progress")
+			return
+		}
+	}
+}
+
+func (c *Client) shutdown(deadline time.Time) {
+	c.close(websocket.CloseServiceRestart, "server restarting", deadline)
+}
+
+type closeRequest struct {
+	code     int
+	reason   string
+	deadline time.Time
+}
+
+/* Have writeMessages send whatever is queued for the client, then a
+   close frame, and wait for it until the deadline. */
+func (c *Client) close(code int, reason string, deadline time.Time) {
+	if c.connection == nil {
+		return
+	}
+	c.closeOnce.Do(func() {
+		c.closing <- closeRequest{code: code, reason: reason, deadline: deadline}
+	})
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+	}
+	c.connection.Close()
+}
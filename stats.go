@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Statistics for one player over all stored games. Bots are counted
+   per model, under the name "ChatBot (<model>)". */
+type PlayerStats struct {
+	Name           string       `json:"name"`
+	Bot            bool         `json:"bot"`
+	Games          int          `json:"games"`
+	Wins           map[Role]int `json:"wins"`
+	Losses         map[Role]int `json:"losses"`
+
+	/* As cluegiver. ClueHits counts correct guesses made on the
+	   player's clues, up to the number of cards in each clue. */
+	Clues          int          `json:"clues"`
+	ClueCards      int          `json:"clueCards"`
+	ClueHits       int          `json:"clueHits"`
+	AssassinHits   int          `json:"assassinHits"`
+
+	/* As guesser. */
+	Guesses        int          `json:"guesses"`
+	CorrectGuesses int          `json:"correctGuesses"`
+
+	AvgCardsPerClue float64     `json:"avgCardsPerClue"`
+	ClueSuccessRate float64     `json:"clueSuccessRate"`
+	GuessAccuracy   float64     `json:"guessAccuracy"`
+}
+
+type StatsList map[string]*PlayerStats
+
+func botStatsName(model string) string {
+	if model == "" {
+		return botName
+	}
+	return botName + " (" + model + ")"
+}
+
+func (sl StatsList) get(name string, bot bool) *PlayerStats {
+	if _, exists := sl[name]; !exists {
+		sl[name] = &PlayerStats{
+			Name:   name,
+			Bot:    bot,
+			Wins:   map[Role]int{cluegiver: 0, guesser: 0},
+			Losses: map[Role]int{cluegiver: 0, guesser: 0},
+		}
+	}
+	return sl[name]
+}
+
+/* Add one game to the statistics. */
+func (sl StatsList) add(r *GameRecord) {
+	/* Bots are counted by model: the seat's, or the one model of
+	   older games. */
+	botStats := func(t Team, role Role) string {
+		if seat, found := r.Bots.seat(t, role); found {
+			return botStatsName(seat.Model)
+		}
+		return botStatsName(r.BotModel)
+	}
+	playerName := func(step *LogEntry) (string, bool) {
+		if step.Actor == botName {
+			return botStats(step.Team, step.Role), true
+		}
+		return step.Actor, false
+	}
+
+	/* Wins and losses by role. Abandoned games don't count. */
+	decided := r.Cause != OutcomeAbandoned && r.Winner != ""
+	result := func(ps *PlayerStats, team Team, role Role) {
+		if !decided {
+			return
+		}
+		if team == r.Winner {
+			ps.Wins[role]++
+		} else {
+			ps.Losses[role]++
+		}
+	}
+	for _, p := range r.Players {
+		ps := sl.get(p.Name, false)
+		ps.Games++
+		result(ps, p.Team, p.Role)
+	}
+	/* One bot may fill several seats in the same game. */
+	botPlayed := make(map[string]bool)
+	for _, t := range []Team{ red, blue } {
+		for _, role := range []Role{ cluegiver, guesser } {
+			if r.Bots.hasTeamAction(t, role) {
+				name := botStats(t, role)
+				ps := sl.get(name, true)
+				if !botPlayed[name] {
+					ps.Games++
+					botPlayed[name] = true
+				}
+				result(ps, t, role)
+			}
+		}
+	}
+
+	/* Follow each clue to the guesses made on it. */
+	var (
+		clue     *LogEntry
+		clueHits int
+	)
+	for i := range r.Steps {
+		step := &r.Steps[i]
+		switch step.Action {
+		case LogClue:
+			clue = step
+			clueHits = 0
+			ps := sl.get(playerName(step))
+			ps.Clues++
+			if step.Number > 0 {
+				ps.ClueCards += step.Number
+			}
+		case LogGuess:
+			ps := sl.get(playerName(step))
+			ps.Guesses++
+			if step.Correct {
+				ps.CorrectGuesses++
+			}
+			if clue == nil || clue.Team != step.Team {
+				continue
+			}
+			cg := sl.get(playerName(clue))
+			if step.Correct && clue.Number > 0 && clueHits < clue.Number {
+				clueHits++
+				cg.ClueHits++
+			}
+			if step.Result == deathCard {
+				cg.AssassinHits++
+			}
+		}
+	}
+}
+
+func (ps *PlayerStats) summarize() {
+	if ps.Clues > 0 {
+		ps.AvgCardsPerClue = float64(ps.ClueCards) / float64(ps.Clues)
+	}
+	if ps.ClueCards > 0 {
+		ps.ClueSuccessRate = float64(ps.ClueHits) / float64(ps.ClueCards)
+	}
+	if ps.Guesses > 0 {
+		ps.GuessAccuracy = float64(ps.CorrectGuesses) / float64(ps.Guesses)
+	}
+}
+
+func (ps *PlayerStats) totalWins() int {
+	return ps.Wins[cluegiver] + ps.Wins[guesser]
+}
+
+/* Players ordered by number of wins, then by fewest games. */
+func (sl StatsList) leaderboard() []*PlayerStats {
+	board := make([]*PlayerStats, 0, len(sl))
+	for _, ps := range sl {
+		ps.summarize()
+		board = append(board, ps)
+	}
+	sort.Slice(board, func(i, j int) bool {
+		if board[i].totalWins() != board[j].totalWins() {
+			return board[i].totalWins() > board[j].totalWins()
+		}
+		if board[i].Games != board[j].Games {
+			return board[i].Games < board[j].Games
+		}
+		return board[i].Name < board[j].Name
+	})
+	return board
+}
+
+func computeStats(records []*GameRecord) StatsList {
+	sl := make(StatsList)
+	for _, r := range records {
+		sl.add(r)
+	}
+	return sl
+}
+
+/* A copy, for the caller to summarize or trim. */
+func (sl StatsList) clone() StatsList {
+	clone := make(StatsList, len(sl))
+	for name, ps := range sl {
+		copied := *ps
+		copied.Wins = maps.Clone(ps.Wins)
+		copied.Losses = maps.Clone(ps.Losses)
+		clone[name] = &copied
+	}
+	return clone
+}
+
+/* The stats of every stored game, read from the store once and then
+   kept up to date as games are saved. */
+type statsCache struct {
+	sync.Mutex
+	/* nil until first asked for. */
+	list StatsList
+}
+
+/* Stats for every player in every stored game. */
+func (m *Manager) allStats() (StatsList, error) {
+	m.stats.Lock()
+	defer m.stats.Unlock()
+
+	if m.stats.list == nil {
+		records, err := m.store.ByDate(time.Time{}, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		m.stats.list = computeStats(records)
+	}
+	return m.stats.list.clone(), nil
+}
+
+/* Save a finished game and add it to the stats. Both are done under
+   the stats lock, so a first read of the store can't count it twice. */
+func (m *Manager) saveRecord(r *GameRecord) error {
+	m.stats.Lock()
+	defer m.stats.Unlock()
+
+	if err := m.store.Save(r); err != nil {
+		return err
+	}
+	if m.stats.list != nil {
+		m.stats.list.add(r)
+	}
+	return nil
+}
+
+/* /stats returns the leaderboard; /stats?user=<name> returns one
+   player's stats. */
+func (m *Manager) statsHandler(w http.ResponseWriter, r *http.Request) {
+	sl, err := m.allStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if name := r.URL.Query().Get("user"); name != "" {
+		ps, exists := sl[name]
+		if !exists {
+			http.Error(w, "no games found for "+name, http.StatusNotFound)
+			return
+		}
+		ps.summarize()
+		writeJSON(w, ps)
+		return
+	}
+	writeJSON(w, sl.leaderboard())
+}
+
+/* Number of players sent to the lobby leaderboard. */
+const leaderboardSize = 10
+
+func StatsHandler(event Event, c *Client) error {
+	var request StatsRequestEvent
+	if len(event.Payload) > 0 {
+		if err := json.Unmarshal(event.Payload, &request); err != nil {
+			return requestError(ErrCodeBadPayload, "bad payload in request: %v", err)
+		}
+	}
+
+	sl, err := c.manager.allStats()
+	if err != nil {
+		return err
+	}
+	board := sl.leaderboard()
+	if len(board) > leaderboardSize {
+		board = board[:leaderboardSize]
+	}
+	response := StatsResponseEvent{
+		Leaderboard: board,
+	}
+	if request.UserName != "" {
+		if ps, exists := sl[request.UserName]; exists {
+			response.Player = ps
+		}
+	}
+
+	outgoingEvent, err := packageMessage(EventStats, response)
+	if err != nil {
+		return err
+	}
+	outgoingEvent.RequestID = c.manager.requestOf(c)
+	c.send(outgoingEvent)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestComputeStats(t *testing.T) {
+	records := []*GameRecord{
+		{
+			/* alice gives a clue for 2; bob finds one red card, then a
+			   blue one. The bot gives a clue for 3 and hits the assassin. */
+			ID: "game1", Winner: red, Cause: OutcomeAssassin, BotModel: "test-model",
+			Players: []Participant{
+				{Name: "alice", Team: red, Role: cluegiver},
+				{Name: "bob", Team: red, Role: guesser},
+			},
+			Bots: BotActions{
+				Cluegiver: TeamActions{Blue: true},
+				Guesser: TeamActions{Blue: true},
+			},
+			Steps: GameLog{
+				{Action: LogStart, Actor: serverActor},
+				{Action: LogClue, Actor: "alice", Team: red, Number: 2},
+				{Action: LogGuess, Actor: "bob", Team: red, Result: "red", Correct: true},
+				{Action: LogGuess, Actor: "bob", Team: red, Result: "blue"},
+				{Action: LogTurnChange, Actor: serverActor, Team: blue, Role: cluegiver},
+				{Action: LogClue, Actor: botName, Team: blue, Number: 3},
+				{Action: LogGuess, Actor: botName, Team: blue, Result: deathCard},
+				{Action: LogGameOver, Actor: serverActor, Team: red},
+			},
+		},
+		{
+			/* Abandoned games count as played, not won or lost. */
+			ID: "game2", Cause: OutcomeAbandoned,
+			Players: []Participant{
+				{Name: "alice", Team: blue, Role: guesser},
+			},
+		},
+	}
+
+	sl := computeStats(records)
+	board := sl.leaderboard()
+	if len(board) != 3 {
+		t.Fatalf("expected 3 players, got %v", len(board))
+	}
+
+	alice := sl["alice"]
+	if alice.Games != 2 || alice.Wins[cluegiver] != 1 || alice.Losses[guesser] != 0 {
+		t.Errorf("alice: unexpected record: %#v", alice)
+	}
+	if alice.Clues != 1 || alice.AvgCardsPerClue != 2 || alice.ClueSuccessRate != 0.5 {
+		t.Errorf("alice: unexpected clue stats: %#v", alice)
+	}
+
+	bob := sl["bob"]
+	if bob.Guesses != 2 || bob.GuessAccuracy != 0.5 || bob.Wins[guesser] != 1 {
+		t.Errorf("bob: unexpected stats: %#v", bob)
+	}
+
+	bot, exists := sl["ChatBot (test-model)"]
+	if !exists {
+		t.Fatalf("no stats for bot: %v", board)
+	}
+	if !bot.Bot || bot.Games != 1 || bot.Losses[cluegiver] != 1 || bot.Losses[guesser] != 1 {
+		t.Errorf("bot: unexpected record: %#v", bot)
+	}
+	if bot.AssassinHits != 1 || bot.ClueHits != 0 || bot.GuessAccuracy != 0 {
+		t.Errorf("bot: unexpected clue stats: %#v", bot)
+	}
+
+	/* Winners first, then fewest games. */
+	if board[0].Name != "bob" || board[1].Name != "alice" || board[2].Name != bot.Name {
+		t.Errorf("unexpected leaderboard order: %v, %v, %v", board[0].Name, board[1].Name, board[2].Name)
+	}
+}
+
+/* Each bot seat counts toward its own model. */
+func TestComputeStatsBotSeats(t *testing.T) {
+	sl := computeStats([]*GameRecord{{
+		ID: "game1", Winner: blue, Cause: OutcomeAllCards,
+		Players: []Participant{
+			{Name: "alice", Team: red, Role: cluegiver},
+			{Name: "bob", Team: red, Role: guesser},
+		},
+		Bots: BotActions{
+			Cluegiver: TeamActions{Blue: true},
+			Guesser: TeamActions{Blue: true},
+			Seats: []BotSeat{
+				{Team: blue, Role: cluegiver, Model: "smart"},
+				{Team: blue, Role: guesser, Model: "fast"},
+			},
+		},
+		Steps: GameLog{
+			{Action: LogClue, Actor: botName, Team: blue, Role: cluegiver, Number: 1},
+			{Action: LogGuess, Actor: botName, Team: blue, Role: guesser, Result: "blue", Correct: true},
+		},
+	}})
+	smart, fast := sl["ChatBot (smart)"], sl["ChatBot (fast)"]
+	if smart == nil || smart.Games != 1 || smart.Wins[cluegiver] != 1 || smart.Clues != 1 || smart.ClueHits != 1 {
+		t.Errorf("cluegiver bot: %#v", smart)
+	}
+	if fast == nil || fast.Games != 1 || fast.Wins[guesser] != 1 || fast.CorrectGuesses != 1 || fast.Clues != 0 {
+		t.Errorf("guesser bot: %#v", fast)
+	}
+}
+
+/* Games saved after the stats are first read are added to them once. */
+func TestStatsCache(t *testing.T) {
+	manager := NewManager(context.Background())
+	game := func(id string) *GameRecord {
+		return &GameRecord{
+			ID: id, Winner: red, Cause: OutcomeAllCards,
+			Players: []Participant{{Name: "alice", Team: red, Role: cluegiver}},
+		}
+	}
+	manager.saveRecord(game("game1"))
+	sl, err := manager.allStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl["alice"].Games = 100
+	manager.saveRecord(game("game2"))
+	sl, _ = manager.allStats()
+	if sl["alice"].Games != 2 || sl["alice"].Wins[cluegiver] != 2 {
+		t.Errorf("alice: %#v", sl["alice"])
+	}
+
+	/* Nobody may pass for a bot. */
+	for _, name := range []string{botName, "chatbot", "ChatBot-red-guesser", serverActor} {
+		if validUsername(name) == nil {
+			t.Errorf("user name %v allowed", name)
+		}
+	}
+	if err := validUsername("alice"); err != nil {
+		t.Error(err)
+	}
+}
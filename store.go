@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrGameNotFound = errors.New("game not found")
+
+/* Completed games. Implementations must be safe for concurrent use.
+   Query results are ordered by the time the game ended. */
+type GameStore interface {
+	Save(record *GameRecord) error
+	Get(id string) (*GameRecord, error)
+	ByUser(username string) ([]*GameRecord, error)
+	ByRoom(room string) ([]*GameRecord, error)
+	/* Games that ended in the interval [from, to). */
+	ByDate(from time.Time, to time.Time) ([]*GameRecord, error)
+	Close() error
+}
+
+/* Number of games kept by the default in-memory store. */
+const memoryStoreGames = 100
+
+/* In-memory store, used when no file-backed store is configured.
+   Only the most recent maxGames games are kept. Accounts are kept
+   too, until the server stops. */
+type MemoryStore struct {
+	sync.RWMutex
+	games    map[string]*GameRecord
+	order    []string
+	maxGames int
+	accounts map[string]*Account
+}
+
+func NewMemoryStore(maxGames int) *MemoryStore {
+	return &MemoryStore{
+		games:    make(map[string]*GameRecord),
+		maxGames: maxGames,
+		accounts: make(map[string]*Account),
+	}
+}
+
+func (s *MemoryStore) Save(record *GameRecord) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.games[record.ID]; !exists {
+		s.order = append(s.order, record.ID)
+	}
+	s.games[record.ID] = record
+	for s.maxGames > 0 && len(s.order) > s.maxGames {
+		delete(s.games, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*GameRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	record, exists := s.games[id]
+	if !exists {
+		return nil, ErrGameNotFound
+	}
+	return record, nil
+}
+
+func (s *MemoryStore) filter(keep func(*GameRecord) bool) []*GameRecord {
+	s.RLock()
+	defer s.RUnlock()
+
+	records := []*GameRecord{}
+	for _, id := range s.order {
+		if keep(s.games[id]) {
+			records = append(records, s.games[id])
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Ended.Before(records[j].Ended)
+	})
+	return records
+}
+
+func (s *MemoryStore) ByUser(username string) ([]*GameRecord, error) {
+	return s.filter(func(r *GameRecord) bool {
+		for _, name := range r.usernames() {
+			if name == username {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (s *MemoryStore) ByRoom(room string) ([]*GameRecord, error) {
+	return s.filter(func(r *GameRecord) bool {
+		return r.Room == room
+	}), nil
+}
+
+func (s *MemoryStore) ByDate(from time.Time, to time.Time) ([]*GameRecord, error) {
+	return s.filter(func(r *GameRecord) bool {
+		return !r.Ended.Before(from) && r.Ended.Before(to)
+	}), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+/* File-backed store using an embedded bolt database. Games are kept
+   as JSON in one bucket, keyed by game ID. Index buckets map
+   "<key>\x00<end time>\x00<game ID>" to the game ID so queries are
+   range scans in end-time order. */
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var (
+	gamesBucket  = []byte("games")
+	byDateBucket = []byte("games_by_date")
+	byUserBucket = []byte("games_by_user")
+	byRoomBucket = []byte("games_by_room")
+)
+
+/* Sortable timestamp for index keys. */
+const indexTimeFormat = "20060102T150405.000000000Z"
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open game store %v: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{gamesBucket, byDateBucket, byUserBucket, byRoomBucket, accountsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not initialize game store %v: %v", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func indexKey(key string, ended time.Time, id string) []byte {
+	return []byte(key + "\x00" + ended.UTC().Format(indexTimeFormat) + "\x00" + id)
+}
+
+func (s *BoltStore) Save(record *GameRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not marshal game %v: %v", record.ID, err)
+	}
+	id := []byte(record.ID)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(gamesBucket).Put(id, data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(byDateBucket).Put(indexKey("", record.Ended, record.ID), id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(byRoomBucket).Put(indexKey(record.Room, record.Ended, record.ID), id); err != nil {
+			return err
+		}
+		users := tx.Bucket(byUserBucket)
+		for _, name := range record.usernames() {
+			if err := users.Put(indexKey(name, record.Ended, record.ID), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getRecord(tx *bolt.Tx, id []byte) (*GameRecord, error) {
+	data := tx.Bucket(gamesBucket).Get(id)
+	if data == nil {
+		return nil, ErrGameNotFound
+	}
+	var record GameRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("could not unmarshal game %s: %v", id, err)
+	}
+	return &record, nil
+}
+
+func (s *BoltStore) Get(id string) (*GameRecord, error) {
+	var record *GameRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx, []byte(id))
+		return err
+	})
+	return record, err
+}
+
+/* Collect the games whose index keys fall in [start, end). */
+func (s *BoltStore) scan(bucket []byte, start []byte, end []byte) ([]*GameRecord, error) {
+	records := []*GameRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, id := c.Seek(start); k != nil && string(k) < string(end); k, id = c.Next() {
+			record, err := getRecord(tx, id)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+/* All index keys for one user or room: "<key>\x00" up to "<key>\x01". */
+func (s *BoltStore) scanKey(bucket []byte, key string) ([]*GameRecord, error) {
+	return s.scan(bucket, []byte(key+"\x00"), []byte(key+"\x01"))
+}
+
+func (s *BoltStore) ByUser(username string) ([]*GameRecord, error) {
+	return s.scanKey(byUserBucket, username)
+}
+
+func (s *BoltStore) ByRoom(room string) ([]*GameRecord, error) {
+	return s.scanKey(byRoomBucket, room)
+}
+
+func (s *BoltStore) ByDate(from time.Time, to time.Time) ([]*GameRecord, error) {
+	return s.scan(byDateBucket, indexKey("", from, ""), indexKey("", to, ""))
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
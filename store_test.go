@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func storeRecords(t *testing.T) []*GameRecord {
+	t.Helper()
+
+	day := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	return []*GameRecord{
+		{
+			ID: "game1", Room: "den", Ended: day,
+			Players: []Participant{{Name: "alice"}, {Name: "bob"}},
+			Winner: red, Cause: OutcomeAllCards,
+		},
+		{
+			ID: "game2", Room: "den", Ended: day.Add(24 * time.Hour),
+			Players: []Participant{{Name: "alice"}},
+			Winner: blue, Cause: OutcomeAssassin,
+		},
+		{
+			ID: "game3", Room: "attic", Ended: day.Add(48 * time.Hour),
+			Players: []Participant{{Name: "bob"}},
+			Cause: OutcomeAbandoned,
+		},
+	}
+}
+
+func ids(records []*GameRecord) []string {
+	s := make([]string, len(records))
+	for i, r := range records {
+		s[i] = r.ID
+	}
+	return s
+}
+
+func checkStore(t *testing.T, store GameStore) {
+	t.Helper()
+
+	records := storeRecords(t)
+	if r, err := store.Get("game1"); err != nil || r.Winner != red || r.Room != "den" {
+		t.Errorf("Get: got %#v, %v", r, err)
+	}
+	if _, err := store.Get("nonesuch"); err != ErrGameNotFound {
+		t.Errorf("Get: expected ErrGameNotFound, got %v", err)
+	}
+
+	type test struct {
+		name   string
+		query  func() ([]*GameRecord, error)
+		expect []string
+	}
+	tests := []test{
+		{ name: "user alice", query: func() ([]*GameRecord, error) { return store.ByUser("alice") }, expect: []string{"game1", "game2"} },
+		{ name: "user bob", query: func() ([]*GameRecord, error) { return store.ByUser("bob") }, expect: []string{"game1", "game3"} },
+		{ name: "user al", query: func() ([]*GameRecord, error) { return store.ByUser("al") }, expect: []string{} },
+		{ name: "room den", query: func() ([]*GameRecord, error) { return store.ByRoom("den") }, expect: []string{"game1", "game2"} },
+		{ name: "all dates", query: func() ([]*GameRecord, error) { return store.ByDate(time.Time{}, time.Now()) }, expect: []string{"game1", "game2", "game3"} },
+		{
+			name: "date range",
+			query: func() ([]*GameRecord, error) { return store.ByDate(records[1].Ended, records[2].Ended) },
+			expect: []string{"game2"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.query()
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.expect) {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.expect, ids(got))
+			continue
+		}
+		for i := range got {
+			if got[i].ID != tt.expect[i] {
+				t.Errorf("%v: expected %v, got %v", tt.name, tt.expect, ids(got))
+				break
+			}
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(0)
+	for _, r := range storeRecords(t) {
+		store.Save(r)
+	}
+	checkStore(t, store)
+
+	/* Oldest games are dropped once the store is full. */
+	small := NewMemoryStore(2)
+	for _, r := range storeRecords(t) {
+		small.Save(r)
+	}
+	if _, err := small.Get("game1"); err != ErrGameNotFound {
+		t.Error("oldest game should have been dropped")
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.db")
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range storeRecords(t) {
+		if err := store.Save(r); err != nil {
+			t.Fatalf("could not save %v: %v", r.ID, err)
+		}
+	}
+	checkStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Games survive reopening the store. */
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	checkStore(t, store)
+}
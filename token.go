@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/* Shortest signing key accepted, in bytes. */
+const minTokenKeyLength = 32
+
+/* Signed login tokens: the OTP carries the user name and its expiry,
+   signed with a key every instance shares, so serveWS checks it
+   without looking anything up. A replay cache keeps each token
+   single-use until it expires. */
+type TokenStore struct {
+	key      []byte
+	lifetime time.Duration
+	/* Spent tokens, when several instances must agree on them. */
+	broker   Broker
+	replays  replayCache
+}
+
+type tokenClaims struct {
+	Username string `json:"user"`
+	/* Unix milliseconds. */
+	Expires  int64  `json:"exp"`
+	ID       string `json:"id"`
+}
+
+/* broker may be nil for a single instance. */
+func NewTokenStore(key []byte, lifetime time.Duration, broker Broker) (*TokenStore, error) {
+	if len(key) < minTokenKeyLength {
+		return nil, fmt.Errorf("token key must be at least %v bytes", minTokenKeyLength)
+	}
+	return &TokenStore{
+		key:      key,
+		lifetime: lifetime,
+		broker:   broker,
+		replays:  replayCache{seen: make(map[string]time.Time)},
+	}, nil
+}
+
+/* The signing key: the key itself if given, else the contents of the file. */
+func readTokenKey(key string, path string) ([]byte, error) {
+	if key != "" {
+		return []byte(key), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token key: %v", err)
+	}
+	return []byte(strings.TrimSpace(string(data))), nil
+}
+
+func (s *TokenStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *TokenStore) NewOTP(username string) (OTP, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		Username: username,
+		Expires:  now.Add(s.lifetime).UnixMilli(),
+		ID:       uuid.NewString(),
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return OTP{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return OTP{
+		Username: username,
+		Key:      payload + "." + s.sign(payload),
+		Created:  now,
+	}, nil
+}
+
+func (s *TokenStore) VerifyOTP(key string) (string, error) {
+	payload, signature, found := strings.Cut(key, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return "", nil
+	}
+	expires := time.UnixMilli(claims.Expires)
+	if !time.Now().Before(expires) {
+		return "", nil
+	}
+
+	first, err := s.spend(claims.ID, expires)
+	if err != nil || !first {
+		return "", err
+	}
+	return claims.Username, nil
+}
+
+/* Record that the token was used. Returns false if it already was. */
+func (s *TokenStore) spend(id string, expires time.Time) (bool, error) {
+	if s.broker == nil {
+		return s.replays.spend(id, expires), nil
+	}
+	/* Only the first claim gets its own, unique, owner back. */
+	spender := uuid.NewString()
+	owner, err := s.broker.Claim(otpClaim(id), spender, time.Until(expires))
+	if err != nil {
+		return false, fmt.Errorf("could not check token for replay: %v", err)
+	}
+	return owner == spender, nil
+}
+
+/* Tokens seen, until they expire. */
+type replayCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func (rc *replayCache) spend(id string, expires time.Time) bool {
+	rc.Lock()
+	defer rc.Unlock()
+
+	now := time.Now()
+	for seen, until := range rc.seen {
+		if !now.Before(until) {
+			delete(rc.seen, seen)
+		}
+	}
+	if _, exists := rc.seen[id]; exists {
+		return false
+	}
+	rc.seen[id] = expires
+	return true
+}
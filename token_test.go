@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTokenKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestTokenStore(t *testing.T) {
+	if _, err := NewTokenStore([]byte("short"), time.Minute, nil); err == nil {
+		t.Error("short key accepted")
+	}
+
+	store, err := NewTokenStore(testTokenKey, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOTPStore(t, store)
+
+	otp, _ := store.NewOTP("alice")
+	payload, signature, _ := strings.Cut(otp.Key, ".")
+	forged, _ := NewTokenStore([]byte(strings.Repeat("x", minTokenKeyLength)), time.Minute, nil)
+	forgery, _ := forged.NewOTP("alice")
+	for _, key := range []string{
+		"",
+		payload,
+		payload + ".",
+		payload + "." + signature[1:],
+		strings.ToUpper(payload) + "." + signature,
+		forgery.Key,
+	} {
+		if username, _ := store.VerifyOTP(key); username != "" {
+			t.Errorf("bad token %q verified for %v", key, username)
+		}
+	}
+	if username, _ := store.VerifyOTP(otp.Key); username != "alice" {
+		t.Errorf("token not verified after bad attempts: %q", username)
+	}
+
+	short, _ := NewTokenStore(testTokenKey, 50*time.Millisecond, nil)
+	otp, _ = short.NewOTP("late")
+	time.Sleep(100 * time.Millisecond)
+	if username, _ := short.VerifyOTP(otp.Key); username != "" {
+		t.Error("expired token verified")
+	}
+	if len(short.replays.seen) != 0 {
+		t.Error("replay cache holds expired tokens")
+	}
+}
+
+/* Issued by one instance, accepted once by any. */
+func TestSharedTokens(t *testing.T) {
+	broker := NewLocalBroker()
+	storeA, _ := NewTokenStore(testTokenKey, time.Minute, broker)
+	storeB, _ := NewTokenStore(testTokenKey, time.Minute, broker)
+	checkOTPStore(t, storeA)
+
+	otp, _ := storeA.NewOTP("bob")
+	if username, _ := storeB.VerifyOTP(otp.Key); username != "bob" {
+		t.Errorf("token from A not accepted by B: %q", username)
+	}
+	if username, _ := storeA.VerifyOTP(otp.Key); username != "" {
+		t.Error("token replayed on another instance")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "expert-garbanzo"
+
+/* Where spans go. */
+const (
+	TraceExporterNone   = "none"
+	/* An OpenTelemetry collector, over OTLP/HTTP. */
+	TraceExporterOTLP   = "otlp"
+	/* JSON, for local debugging. */
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+)
+
+/* Spans are no-ops until setupTracing installs an exporter. */
+var tracer = otel.Tracer(serviceName)
+
+/* Send spans to the configured exporter. Returns a function that
+   flushes and stops it at shutdown. */
+func setupTracing(ctx context.Context, cfg *Config, instance string) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		file     *os.File
+		err      error
+	)
+	switch cfg.TraceExporter {
+	case TraceExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TraceExporterOTLP:
+		/* Without an endpoint, the exporter reads OTEL_EXPORTER_OTLP_ENDPOINT
+		   and defaults to localhost:4318. */
+		var opts []otlptracehttp.Option
+		if cfg.TraceEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.TraceEndpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case TraceExporterFile:
+		file, err = os.OpenFile(cfg.TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open trace file: %v", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("invalid trace exporter: %v", cfg.TraceExporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not start trace exporter: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceInstanceID(instance),
+			semconv.ServiceVersion(readBuildInfo().Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+/* Attribute keys shared by the spans. */
+const (
+	attrGame    = attribute.Key("game.id")
+	attrRoom    = attribute.Key("room")
+	attrUser    = attribute.Key("user")
+	attrEvent   = attribute.Key("event.type")
+	attrRequest = attribute.Key("request.id")
+	attrTeam    = attribute.Key("team")
+	attrRole    = attribute.Key("role")
+	attrModel   = attribute.Key("llm.model")
+)
+
+/* Start a span. A nil parent starts a new trace. */
+func startSpan(parent context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	return tracer.Start(parent, name, trace.WithAttributes(attrs...))
+}
+
+/* End the span, marking it failed if err is not nil. */
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+/* Start a span under the one the room is in, and make it the room's
+   current span until the returned function ends it. Spans started
+   on the room's goroutine in between, e.g. by the recursion between
+   botPlay and GuessEvaluation, nest under it. Must be called on the
+   room's goroutine. */
+func (r *Room) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	parent := r.ctx
+	ctx, span := startSpan(parent, name, append(attrs, attrRoom.String(r.name))...)
+	r.ctx = ctx
+	return ctx, func(err error) {
+		endSpan(span, err)
+		r.ctx = parent
+	}
+}
+
+/* The trace context of the event being handled for the client.
+   Must be called on the goroutine handling the client's events. */
+func (m *Manager) traceContext(c *Client) context.Context {
+	room := m.room(c.room())
+	if room == nil {
+		room = m.room(defaultChatRoom)
+	}
+	return room.ctx
+}
+
+/* Start a span for the game under its room's current span. Must be
+   called on the room's goroutine. */
+func (game *Game) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	attrs = append(attrs, attrGame.String(game.id))
+	if game.manager != nil {
+		if room := game.manager.room(game.name); room != nil {
+			return room.startSpan(name, attrs...)
+		}
+	}
+	ctx, span := startSpan(nil, name, attrs...)
+	return ctx, func(err error) {
+		endSpan(span, err)
+	}
+}
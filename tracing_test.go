@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer func(old trace.Tracer) { tracer = old }(tracer)
+	tracer = provider.Tracer(serviceName)
+
+	defer func(ask func(*Bot, string, string) (openai.ChatCompletionResponse, error)) {
+		askLLMBot = ask
+	}(askLLMBot)
+	askLLMBot = func(bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+		return openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{
+				{Message: openai.ChatCompletionMessage{Content: "BLUE, 1, BLUEWORD"}},
+			},
+		}, nil
+	}
+
+	/* A wrong guess hands the turn to the bot spymaster. */
+	manager := setupDeck(t, nil, &BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Blue: true},
+	})
+	manager.makeChatRoom("test")
+	client := manager.clients["testClient1"]
+	game := manager.games["test"]
+	game.roleTurn = guesser
+	guess, _ := json.Marshal(GuessEvent{Guess: "neutralword", Guesser: "testClient1"})
+	manager.routeEvent(Event{Type: EventMakeGuess, Payload: guess, RequestID: "r1"}, client)
+
+	/* The bot's clue hands the turn to the bot guesser in turn, so
+	   spans can appear more than once: take the first started. */
+	byID := map[trace.SpanID]sdktrace.ReadOnlySpan{}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		byID[span.SpanContext().SpanID()] = span
+		if first, seen := spans[span.Name()]; !seen || span.StartTime().Before(first.StartTime()) {
+			spans[span.Name()] = span
+		}
+	}
+	root := spans["routeEvent"]
+	if root == nil {
+		t.Fatal("no routeEvent span")
+	}
+	for child, parent := range map[string]string{
+		"handle guess_event": "routeEvent",
+		"GuessEvaluation":    "handle guess_event",
+		"botPlay":            "handle guess_event",
+		"Bot.Play":           "botPlay",
+		"llm.request":        "Bot.Play",
+		"llm.parse":          "Bot.Play",
+	} {
+		span, ok := spans[child]
+		if !ok {
+			t.Errorf("no %v span", child)
+			continue
+		}
+		if p, ok := byID[span.Parent().SpanID()]; !ok || p.Name() != parent {
+			t.Errorf("%v is not a child of %v", child, parent)
+		}
+	}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("%v is not in the event's trace", span.Name())
+		}
+	}
+
+	gameID := attribute.String(string(attrGame), game.id)
+	for _, name := range []string{"routeEvent", "botPlay", "llm.request"} {
+		found := false
+		for _, attr := range spans[name].Attributes() {
+			found = found || attr == gameID
+		}
+		if !found {
+			t.Errorf("%v has no game ID: %v", name, spans[name].Attributes())
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+)
+
+/* One bot turn: what the bot was asked, what it answered, what was
+   read from the answer, and what came of it. */
+type BotTurn struct {
+	Time        time.Time `json:"time"`
+	Team        Team      `json:"team"`
+	Role        Role      `json:"role"`
+	Model       string    `json:"model"`
+	Persona     string    `json:"persona,omitempty"`
+	Temperature *float32  `json:"temperature,omitempty"`
+	System      string    `json:"system"`
+	User        string    `json:"user"`
+	Response    string    `json:"response"`
+	Error       string    `json:"error,omitempty"`
+	/* Read from the response. */
+	Clue        string    `json:"clue,omitempty"`
+	NumGuess    int       `json:"numGuess,omitempty"`
+	Match       string    `json:"match,omitempty"`
+	Guesses     []string  `json:"guesses,omitempty"`
+	/* The clue given, or the words guessed, in order. Guesses not
+	   played are skipped: words not on the board or already guessed,
+	   and those after a wrong guess. */
+	Played      []string  `json:"played"`
+	Skipped     []string  `json:"skipped,omitempty"`
+	/* Humans share the bot's role, so the bot only made a suggestion. */
+	Suggested   bool      `json:"suggested,omitempty"`
+}
+
+func newBotTurn(clue *ClueStruct, team Team, role Role, bot *Bot) BotTurn {
+	turn := BotTurn{
+		Time:        time.Now(),
+		Team:        team,
+		Role:        role,
+		Model:       bot.model,
+		Persona:     bot.persona.Name,
+		Temperature: bot.temperature,
+		System:   clue.prompt,
+		User:     clue.message,
+		Response: clue.response,
+		Played:   []string{},
+	}
+	if clue.err != nil {
+		turn.Error = clue.err.Error()
+	}
+	switch role {
+	case cluegiver:
+		turn.Clue = clue.word
+		turn.NumGuess = clue.numGuess
+		turn.Match = clue.match
+	case guesser:
+		turn.Guesses = slices.Clone(clue.capsWords)
+	}
+	return turn
+}
+
+/* Add a bot turn to the transcript. Returns its index, for recording
+   its plays. */
+func (game *Game) addBotTurn(turn BotTurn) int {
+	game.transcript = append(game.transcript, turn)
+	return len(game.transcript) - 1
+}
+
+/* A copy of the transcript so far, with the guesses not played marked
+   skipped. */
+func (game *Game) botTranscript() []BotTurn {
+	turns := make([]BotTurn, len(game.transcript))
+	for i, turn := range game.transcript {
+		turn.Played = slices.Clone(turn.Played)
+		turn.Skipped = nil
+		for _, guess := range turn.Guesses {
+			if !slices.Contains(turn.Played, guess) {
+				turn.Skipped = append(turn.Skipped, guess)
+			}
+		}
+		turns[i] = turn
+	}
+	return turns
+}
+
+type transcriptResponse struct {
+	GameID string    `json:"gameId"`
+	Room   string    `json:"room"`
+	Active bool      `json:"active"`
+	Turns  []BotTurn `json:"turns"`
+}
+
+/* The bot transcript of a finished game: GET /transcript?id=...
+   Games in progress are left out, as the spymaster bot's prompts
+   show which cards are whose. */
+func (m *Manager) transcriptHandler(w http.ResponseWriter, r *http.Request) {
+	m.writeTranscript(w, r, false)
+}
+
+/* The bot transcript of any game, including those in progress on
+   this instance: GET /admin/transcript?id=... */
+func (m *Manager) adminTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	m.writeTranscript(w, r, true)
+}
+
+func (m *Manager) writeTranscript(w http.ResponseWriter, r *http.Request, live bool) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing game id", http.StatusBadRequest)
+		return
+	}
+
+	var busy []string
+	if live {
+		var answers []transcriptResponse
+		answers, busy = queryRooms(m.rooms(), adminRoomTimeout, func(room *Room) (transcriptResponse, bool) {
+			game := m.game(room.name)
+			if game == nil || game.id != id {
+				return transcriptResponse{}, false
+			}
+			return transcriptResponse{
+				GameID: game.id,
+				Room:   game.name,
+				Active: game.active,
+				Turns:  game.botTranscript(),
+			}, true
+		})
+		if len(answers) > 0 {
+			writeJSON(w, answers[0])
+			return
+		}
+	}
+
+	record, err := m.store.Get(id)
+	if errors.Is(err, ErrGameNotFound) && len(busy) > 0 {
+		/* The game may be in one of them. */
+		http.Error(w, "game "+id+" not found, and some rooms are busy; try again", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, ErrGameNotFound) {
+		http.Error(w, "game "+id+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	turns := record.Transcript
+	if turns == nil {
+		turns = []BotTurn{}
+	}
+	writeJSON(w, transcriptResponse{GameID: record.ID, Room: record.Room, Turns: turns})
+}
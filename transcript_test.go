@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestBotTranscript(t *testing.T) {
+	defer func(ask func(*Bot, string, string) (openai.ChatCompletionResponse, error)) {
+		askLLMBot = ask
+	}(askLLMBot)
+	askLLMBot = func(bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+		response := "NOPE BLUEWORD NEUTRALWORD REDWORD"
+		if strings.Contains(system, "Spymaster") {
+			response = "Clue: Azure\nNumber of words that match the clue: 2\n" +
+				"Words that match the clue: BLUEWORD, OTHERBLUE"
+		}
+		return openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{
+				{Message: openai.ChatCompletionMessage{Content: response}},
+			},
+		}, nil
+	}
+
+	manager := setupGame(t, nil, &BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Blue: true},
+	})
+	manager.makeChatRoom("test")
+	manager.adminToken = testAdminToken
+	game := manager.games["test"]
+	game.cards = Deck{
+		"BLUEWORD":    "blue",
+		"OTHERBLUE":   "blue",
+		"NEUTRALWORD": "neutral",
+		"REDWORD":     "red",
+		"DEATHWORD":   deathCard,
+	}
+	game.teamTurn = blue
+	game.roleTurn = cluegiver
+	if err := game.botPlay(GiveClueEvent{}); err != nil {
+		t.Fatal(err)
+	}
+
+	transcript := func(handler http.HandlerFunc) (int, transcriptResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/transcript?id="+game.id, nil))
+		var resp transcriptResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	/* Players wait for the end of the game; admins don't. */
+	if code, _ := transcript(manager.transcriptHandler); code != http.StatusNotFound {
+		t.Errorf("transcript of a game in progress: got %v", code)
+	}
+	admin := func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		manager.admin(manager.adminTranscriptHandler)(w, r)
+	}
+	if code, resp := transcript(admin); code != http.StatusOK || !resp.Active || len(resp.Turns) != 2 {
+		t.Errorf("admin transcript of a game in progress: %v, %+v", code, resp)
+	}
+
+	manager.removeGame("test")
+	code, resp := transcript(manager.transcriptHandler)
+	if code != http.StatusOK || len(resp.Turns) != 2 {
+		t.Fatalf("transcript: %v, %+v", code, resp)
+	}
+	clue, guess := resp.Turns[0], resp.Turns[1]
+	if clue.Role != cluegiver || clue.Team != blue || clue.Clue != "Azure" || clue.NumGuess != 2 ||
+		!strings.Contains(clue.User, "BLUEWORD") || slices.Compare(clue.Played, []string{"Azure"}) != 0 {
+		t.Errorf("clue turn: %+v", clue)
+	}
+	if guess.Role != guesser || !strings.Contains(guess.User, "Azure") || guess.Response != "NOPE BLUEWORD NEUTRALWORD REDWORD" ||
+		slices.Compare(guess.Played, []string{"BLUEWORD", "NEUTRALWORD"}) != 0 ||
+		slices.Compare(guess.Skipped, []string{"NOPE", "REDWORD"}) != 0 {
+		t.Errorf("guess turn: %+v", guess)
+	}
+
+	/* The replay leaves it out. */
+	w := httptest.NewRecorder()
+	manager.replayHandler(w, httptest.NewRequest(http.MethodGet, "/replay?id="+game.id, nil))
+	if strings.Contains(w.Body.String(), "transcript") {
+		t.Error("replay includes the transcript")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+/* Days of usage kept for the admin API. */
+const usageDays = 31
+
+const (
+	dailyBudgetMessage = "The AI players have used up today's budget. Play without bots, or try again tomorrow."
+	roomBudgetMessage  = "The AI players have used up this room's budget for today. Play without bots, or try again tomorrow."
+)
+
+/* Tokens used by the LLM, over some number of calls. */
+type Usage struct {
+	Calls            int `json:"calls"`
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+func (u *Usage) add(usage openai.Usage) {
+	u.Calls++
+	u.PromptTokens += usage.PromptTokens
+	u.CompletionTokens += usage.CompletionTokens
+	u.TotalTokens += usage.PromptTokens + usage.CompletionTokens
+}
+
+/* Tokens the bots may use each day (UTC), counted on this instance.
+   0 is no limit. */
+type Budgets struct {
+	/* For all rooms together. */
+	Daily int            `json:"daily"`
+	/* For each room, unless Rooms sets its own. */
+	Room  int            `json:"room"`
+	Rooms map[string]int `json:"rooms,omitempty"`
+}
+
+func (b Budgets) room(name string) int {
+	if budget, exists := b.Rooms[name]; exists {
+		return budget
+	}
+	return b.Room
+}
+
+type dayUsage struct {
+	Day   string           `json:"day"`
+	Total Usage            `json:"total"`
+	Rooms map[string]Usage `json:"rooms"`
+}
+
+/* LLM usage by day and by room, and the budgets it is held to. Kept
+   in memory only, so a restart forgets the day's usage. */
+type usageLedger struct {
+	sync.Mutex
+	budgets Budgets
+	days    map[string]*dayUsage
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+func (l *usageLedger) day(now time.Time) *dayUsage {
+	name := usageDay(now)
+	day, exists := l.days[name]
+	if !exists {
+		if l.days == nil {
+			l.days = make(map[string]*dayUsage)
+		}
+		day = &dayUsage{Day: name, Rooms: make(map[string]Usage)}
+		l.days[name] = day
+		oldest := usageDay(now.AddDate(0, 0, -usageDays))
+		for name := range l.days {
+			if name <= oldest {
+				delete(l.days, name)
+			}
+		}
+	}
+	return day
+}
+
+/* Count a call made for a game in the room. */
+func (l *usageLedger) record(room string, usage openai.Usage, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	day := l.day(now)
+	day.Total.add(usage)
+	roomUsage := day.Rooms[room]
+	roomUsage.add(usage)
+	day.Rooms[room] = roomUsage
+}
+
+/* Whether the room may have bots: refused with the reason if today's
+   budget, or the room's, is used up. */
+func (l *usageLedger) allow(room string, now time.Time) error {
+	l.Lock()
+	defer l.Unlock()
+
+	day := l.day(now)
+	if l.budgets.Daily > 0 && day.Total.TotalTokens >= l.budgets.Daily {
+		return requestError(ErrCodeBudgetExhausted, dailyBudgetMessage)
+	}
+	if budget := l.budgets.room(room); budget > 0 && day.Rooms[room].TotalTokens >= budget {
+		return requestError(ErrCodeBudgetExhausted, roomBudgetMessage)
+	}
+	return nil
+}
+
+func (l *usageLedger) setBudgets(budgets Budgets) {
+	l.Lock()
+	defer l.Unlock()
+	l.budgets = budgets
+}
+
+/* A copy of the budgets, safe to change. */
+func (l *usageLedger) getBudgets() Budgets {
+	l.Lock()
+	defer l.Unlock()
+
+	budgets := l.budgets
+	budgets.Rooms = maps.Clone(l.budgets.Rooms)
+	return budgets
+}
+
+/* Usage by day, most recent first. */
+func (l *usageLedger) report() []dayUsage {
+	l.Lock()
+	defer l.Unlock()
+
+	days := make([]dayUsage, 0, len(l.days))
+	for _, day := range l.days {
+		report := *day
+		report.Rooms = maps.Clone(day.Rooms)
+		days = append(days, report)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Day > days[j].Day
+	})
+	return days
+}
+
+type adminUsageResponse struct {
+	Budgets Budgets    `json:"budgets"`
+	Days    []dayUsage `json:"days"`
+}
+
+/* LLM usage on this instance by day and room: GET /admin/usage */
+func (m *Manager) adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, adminUsageResponse{
+		Budgets: m.usage.getBudgets(),
+		Days:    m.usage.report(),
+	})
+}
+
+/* Change the budgets: POST /admin/budgets {"daily": ..., "room": ...,
+   "rooms": {"name": ...}}. Budgets left out are kept. Games with bots
+   already running are not stopped. */
+func (m *Manager) adminBudgetsHandler(w http.ResponseWriter, r *http.Request) {
+	budgets := m.usage.getBudgets()
+	if !adminRequest(w, r, &budgets) {
+		return
+	}
+	if budgets.Daily < 0 || budgets.Room < 0 {
+		http.Error(w, "budgets must not be negative", http.StatusBadRequest)
+		return
+	}
+	for name, budget := range budgets.Rooms {
+		if budget < 0 {
+			http.Error(w, "budget for "+name+" must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+	m.usage.setBudgets(budgets)
+	writeJSON(w, budgets)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestUsageLedger(t *testing.T) {
+	var ledger usageLedger
+	ledger.setBudgets(Budgets{Daily: 1000, Room: 300, Rooms: map[string]int{"big": 0}})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	call := openai.Usage{PromptTokens: 200, CompletionTokens: 50}
+
+	ledger.record("den", call, now)
+	if err := ledger.allow("den", now); err != nil {
+		t.Errorf("den under budget: %v", err)
+	}
+	ledger.record("den", call, now)
+	if err := ledger.allow("den", now); errorCode(err) != ErrCodeBudgetExhausted {
+		t.Errorf("den over budget: %v", err)
+	}
+	if err := ledger.allow("attic", now); err != nil {
+		t.Errorf("other rooms have their own budget: %v", err)
+	}
+
+	/* The room without a limit still counts towards the day's. */
+	for i := 0; i < 2; i++ {
+		ledger.record("big", call, now)
+	}
+	if err := ledger.allow("attic", now); errorCode(err) != ErrCodeBudgetExhausted || err.Error() != dailyBudgetMessage {
+		t.Errorf("daily budget used up: %v", err)
+	}
+
+	tomorrow := now.AddDate(0, 0, 1)
+	if err := ledger.allow("den", tomorrow); err != nil {
+		t.Errorf("den the next day: %v", err)
+	}
+
+	days := ledger.report()
+	if len(days) != 2 || days[0].Day != "2024-03-02" || days[1].Day != "2024-03-01" {
+		t.Fatalf("days: %+v", days)
+	}
+	want := Usage{Calls: 2, PromptTokens: 400, CompletionTokens: 100, TotalTokens: 500}
+	if days[1].Total.TotalTokens != 1000 || days[1].Rooms["den"] != want {
+		t.Errorf("usage: %+v", days[1])
+	}
+
+	/* Old days are forgotten. */
+	ledger.allow("den", now.AddDate(0, 0, usageDays))
+	if days := ledger.report(); len(days) != 2 || days[1].Day != "2024-03-02" {
+		t.Errorf("days after a month: %+v", days)
+	}
+}
+
+func TestBudgetRefusesBots(t *testing.T) {
+	readWordList("./wordlist.txt")
+	manager := NewManager(context.Background())
+	manager.adminToken = testAdminToken
+	alice := NewClient("alice", nil, manager)
+	bob := NewClient("bob", nil, manager)
+	bob.role = cluegiver
+	manager.addClient(alice)
+	manager.addClient(bob)
+	room, _ := json.Marshal(ChangeRoomEvent{RoomName: "den"})
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, alice)
+	manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, bob)
+
+	w := adminCall(manager, manager.adminBudgetsHandler, http.MethodPost, `{"room": 100}`, testAdminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set budgets: got %v", w.Code)
+	}
+	manager.usage.record("den", openai.Usage{PromptTokens: 90, CompletionTokens: 10}, time.Now())
+
+	bots := `{"bots": {"cluegiver": {"blue": true}, "guesser": {"blue": true}}}`
+	manager.routeEvent(Event{Type: EventNewGame, Payload: json.RawMessage(bots)}, alice)
+	var response ErrorEvent
+	json.Unmarshal(waitForEvent(t, alice, EventError).Payload, &response)
+	if response.Code != ErrCodeBudgetExhausted {
+		t.Errorf("game with bots over budget: %+v", response)
+	}
+	var explanation string
+	json.Unmarshal(waitForEvent(t, bob, EventInvalidState).Payload, &explanation)
+	if explanation != roomBudgetMessage {
+		t.Errorf("players told %q", explanation)
+	}
+	if manager.game("den") != nil {
+		t.Error("game made without its bots")
+	}
+
+	/* Players can still play by themselves, with a blue team. */
+	carol := NewClient("carol", nil, manager)
+	carol.team = blue
+	dave := NewClient("dave", nil, manager)
+	dave.team, dave.role = blue, cluegiver
+	for _, c := range []*Client{carol, dave} {
+		manager.addClient(c)
+		manager.routeEvent(Event{Type: EventEnterRoom, Payload: room}, c)
+	}
+	manager.routeEvent(Event{Type: EventNewGame, Payload: json.RawMessage(`{}`)}, alice)
+	waitForEvent(t, alice, EventNewGame)
+
+	w = adminCall(manager, manager.adminUsageHandler, http.MethodGet, "", testAdminToken)
+	var usage adminUsageResponse
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.Budgets.Room != 100 || len(usage.Days) != 1 || usage.Days[0].Rooms["den"].TotalTokens != 100 {
+		t.Errorf("usage: %+v", usage)
+	}
+	if w := adminCall(manager, manager.adminBudgetsHandler, http.MethodPost, `{"daily": -1}`, testAdminToken); w.Code != http.StatusBadRequest {
+		t.Errorf("negative budget: got %v", w.Code)
+	}
+}
+
+/* The budget runs out between the bots' clue and their guess. */
+func TestBudgetStopsBots(t *testing.T) {
+	defer func(ask func(*Bot, string, string) (openai.ChatCompletionResponse, error)) {
+		askLLMBot = ask
+	}(askLLMBot)
+	calls := 0
+	askLLMBot = func(bot *Bot, system string, user string) (openai.ChatCompletionResponse, error) {
+		calls++
+		return openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{
+				{Message: openai.ChatCompletionMessage{Content: "Clue: Azure\nNumber: 1\nWords: BLUEWORD"}},
+			},
+			Usage: openai.Usage{PromptTokens: 100},
+		}, nil
+	}
+	bots := &BotActions{
+		Cluegiver: TeamActions{Blue: true},
+		Guesser:   TeamActions{Blue: true},
+	}
+	/* The bots give a clue, and players in the given blue seats play
+	   alongside them. */
+	play := func(roles ...Role) (*Manager, *Game) {
+		t.Helper()
+		calls = 0
+		manager := setupGame(t, nil, bots)
+		manager.makeChatRoom("test")
+		manager.usage.setBudgets(Budgets{Room: 100})
+		game := manager.games["test"]
+		for _, role := range roles {
+			player := NewClient("blue-"+role.String(), nil, manager)
+			player.team, player.role, player.game = blue, role, game
+			game.players[player.username] = player
+			game.actions[blue][role]++
+		}
+		game.teamTurn = blue
+		game.roleTurn = cluegiver
+		if err := game.botPlay(GiveClueEvent{}); err != nil {
+			t.Fatal(err)
+		}
+		return manager, game
+	}
+	ended := func(manager *Manager, game *Game) {
+		t.Helper()
+		record, err := manager.store.Get(game.id)
+		if err != nil || record.Cause != OutcomeOverBudget || record.Message != roomBudgetMessage {
+			t.Errorf("record: %+v, %v", record, err)
+		}
+		if game.active {
+			t.Error("game still active")
+		}
+	}
+
+	/* Nobody can take the bots' turns, so the game ends. */
+	manager, game := play()
+	if calls != 1 {
+		t.Errorf("bots called the LLM %v times", calls)
+	}
+	ended(manager, game)
+
+	/* Players only lose the bots' suggestions, as long as they hold
+	   every seat the bots do. Having made one, the bots leave the clue
+	   to the players, who pass the turn on. */
+	manager, game = play(cluegiver)
+	game.roleTurn = guesser
+	if err := game.botPlay(GiveClueEvent{Clue: "azure", NumCards: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ended(manager, game)
+
+	manager, game = play(cluegiver, guesser)
+	game.roleTurn = guesser
+	if err := game.botPlay(GiveClueEvent{Clue: "azure", NumCards: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("bots called the LLM %v times", calls)
+	}
+	var explanation string
+	json.Unmarshal(waitForEvent(t, manager.clients["testClient1"], EventInvalidState).Payload, &explanation)
+	if explanation != roomBudgetMessage {
+		t.Errorf("players told %q", explanation)
+	}
+	if !game.active || game.bot != nil {
+		t.Errorf("game active %v, bot %v", game.active, game.bot)
+	}
+}